@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// comparePercentiles are the latency percentiles compared between runs
+var comparePercentiles = []float64{50, 95, 99}
+
+// Run holds the aggregated results of a load test run read from a
+// results file
+type Run struct {
+	metrics *Metrics
+	start   map[string]time.Time // first query start for each group
+	end     map[string]time.Time // last query end for each group
+}
+
+// NewRun aggregates results into a Run
+func NewRun(results []QueryResult) *Run {
+	run := &Run{
+		metrics: NewMetrics(),
+		start:   map[string]time.Time{},
+		end:     map[string]time.Time{},
+	}
+	for _, r := range results {
+		run.metrics.Record(r)
+		if start, ok := run.start[r.Group]; !ok || r.Start.Before(start) {
+			run.start[r.Group] = r.Start
+		}
+		if end := r.Start.Add(r.Duration); end.After(run.end[r.Group]) {
+			run.end[r.Group] = end
+		}
+	}
+	return run
+}
+
+// stats returns the stats of each group, labelled "(all)", and of each
+// query in the group
+func (run *Run) stats() map[metricKey]*Stats {
+	stats := map[metricKey]*Stats{}
+	for g, s := range run.metrics.groups {
+		stats[metricKey{g, "(all)"}] = s
+	}
+	for k, s := range run.metrics.queries {
+		stats[k] = s
+	}
+	return stats
+}
+
+// rate returns the number of successful queries per second in a group
+func (run *Run) rate(group string, s *Stats) float64 {
+	elapsed := run.end[group].Sub(run.start[group]).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Count()) / elapsed
+}
+
+// Comparison compares the results of a group or query in a baseline and
+// a current run
+type Comparison struct {
+	Group, Name   string
+	Base, Current *Stats // nil if missing from the run
+	BaseRate      float64
+	CurrentRate   float64
+	Regressions   []string // measures which have regressed
+}
+
+// errorShare returns the percentage of queries which failed or timed
+// out
+func errorShare(s *Stats) float64 {
+	total := s.Count() + s.Errors + s.Timeouts
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(s.Errors+s.Timeouts) / float64(total)
+}
+
+// change returns the percentage change from base to current, or NaN if
+// base is 0
+func change(base, current float64) float64 {
+	if base == 0 {
+		return math.NaN()
+	}
+	return 100 * (current - base) / base
+}
+
+// Compare compares each group and query of a current run with a
+// baseline run. A regression is a fall in throughput, or a rise in a
+// latency percentile or in the share of queries failing or timing out,
+// by more than threshold percent, any errors where the baseline had
+// none, or a group or query of the baseline missing from the current
+// run.
+func Compare(base, current *Run, threshold float64) []Comparison {
+	baseStats, currentStats := base.stats(), current.stats()
+	keys := []metricKey{}
+	for k := range baseStats {
+		keys = append(keys, k)
+	}
+	for k := range currentStats {
+		if _, ok := baseStats[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sortMetricKeys(keys)
+
+	comparisons := []Comparison{}
+	for _, k := range keys {
+		c := Comparison{Group: k.group, Name: k.name, Base: baseStats[k], Current: currentStats[k]}
+		if c.Current == nil {
+			c.Regressions = append(c.Regressions, "missing")
+		}
+		if c.Base == nil || c.Current == nil {
+			comparisons = append(comparisons, c)
+			continue
+		}
+		c.BaseRate, c.CurrentRate = base.rate(k.group, c.Base), current.rate(k.group, c.Current)
+		if change(c.BaseRate, c.CurrentRate) < -threshold {
+			c.Regressions = append(c.Regressions, "throughput")
+		}
+		for _, p := range comparePercentiles {
+			d := change(float64(c.Base.Percentile(p)), float64(c.Current.Percentile(p)))
+			if d > threshold {
+				c.Regressions = append(c.Regressions, fmt.Sprintf("p%g", p))
+			}
+		}
+		baseErrors, currentErrors := errorShare(c.Base), errorShare(c.Current)
+		if currentErrors > 0 && (baseErrors == 0 || change(baseErrors, currentErrors) > threshold) {
+			c.Regressions = append(c.Regressions, "errors")
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons
+}
+
+// Regressed reports whether any comparison shows a regression
+func Regressed(comparisons []Comparison) bool {
+	for _, c := range comparisons {
+		if len(c.Regressions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// formatChange formats a percentage change
+func formatChange(d float64) string {
+	if math.IsNaN(d) {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", d)
+}
+
+// WriteComparison writes a table of comparisons to w, with current
+// values followed by their change from the baseline, the baseline and
+// current error shares, and timings in milliseconds
+func WriteComparison(w io.Writer, comparisons []Comparison) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "group\tquery\tcount\terrors\tqps\tchange\t"
+	for _, p := range comparePercentiles {
+		header += fmt.Sprintf("p%g\tchange\t", p)
+	}
+	fmt.Fprintln(tw, header+"result\t")
+
+	for _, c := range comparisons {
+		line := fmt.Sprintf("%s\t%s\t", c.Group, shortQuery(c.Name))
+		switch {
+		case c.Current == nil:
+			line += fmt.Sprintf("%d/-\t%.2f%%/-\t", c.Base.Count(), errorShare(c.Base))
+			line += strings.Repeat("\t", 2+2*len(comparePercentiles)) + "regression: missing\t"
+		case c.Base == nil:
+			line += fmt.Sprintf("-/%d\t-/%.2f%%\t", c.Current.Count(), errorShare(c.Current))
+			line += strings.Repeat("\t", 2+2*len(comparePercentiles)) + "new\t"
+		default:
+			line += fmt.Sprintf(
+				"%d/%d\t%.2f%%/%.2f%%\t%.1f\t%s\t",
+				c.Base.Count(), c.Current.Count(), errorShare(c.Base), errorShare(c.Current),
+				c.CurrentRate, formatChange(change(c.BaseRate, c.CurrentRate)),
+			)
+			for _, p := range comparePercentiles {
+				base, current := c.Base.Percentile(p), c.Current.Percentile(p)
+				line += fmt.Sprintf("%s\t%s\t", millis(current), formatChange(change(float64(base), float64(current))))
+			}
+			result := "ok"
+			if len(c.Regressions) > 0 {
+				result = "regression: " + strings.Join(c.Regressions, ", ")
+			}
+			line += result + "\t"
+		}
+		fmt.Fprintln(tw, line)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRun makes a run of n queries in a group, one every interval, each
+// taking duration
+func testRun(group, query string, n int, interval, duration time.Duration) []QueryResult {
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	results := []QueryResult{}
+	for i := 0; i < n; i++ {
+		results = append(results, QueryResult{
+			Group: group, Database: "db1", Query: query,
+			Start: start.Add(time.Duration(i) * interval), Duration: duration,
+		})
+	}
+	return results
+}
+
+func TestCompare(t *testing.T) {
+	base := testRun("g1", "select 1", 100, 10*time.Millisecond, 2*time.Millisecond)
+	base = append(base, testRun("g2", "select 2", 10, 100*time.Millisecond, time.Millisecond)...)
+
+	for _, test := range []struct {
+		msg         string
+		current     []QueryResult
+		regressions []string // for g1 (all)
+	}{
+		{
+			msg:     "unchanged",
+			current: testRun("g1", "select 1", 100, 10*time.Millisecond, 2*time.Millisecond),
+		},
+		{
+			msg:     "within threshold",
+			current: testRun("g1", "select 1", 100, 10*time.Millisecond, 2100*time.Microsecond),
+		},
+		{
+			msg:         "slower",
+			current:     testRun("g1", "select 1", 100, 10*time.Millisecond, 3*time.Millisecond),
+			regressions: []string{"p50", "p95", "p99"},
+		},
+		{
+			msg:         "lower throughput",
+			current:     testRun("g1", "select 1", 100, 20*time.Millisecond, 2*time.Millisecond),
+			regressions: []string{"throughput"},
+		},
+	} {
+		comparisons := Compare(NewRun(base), NewRun(test.current), 10)
+		if len(comparisons) != 4 {
+			t.Fatalf("%s: expected 4 comparisons, got %d", test.msg, len(comparisons))
+		}
+		c := comparisons[0]
+		if c.Group != "g1" || c.Name != "(all)" {
+			t.Fatalf("%s: unexpected first comparison %s %s", test.msg, c.Group, c.Name)
+		}
+		if strings.Join(c.Regressions, ",") != strings.Join(test.regressions, ",") {
+			t.Errorf("%s: regressions %v should be %v", test.msg, c.Regressions, test.regressions)
+		}
+		if Regressed(comparisons[:2]) != (len(test.regressions) > 0) {
+			t.Errorf("%s: regressed should be %t", test.msg, len(test.regressions) > 0)
+		}
+		// g2 is missing from the current run, which is a regression
+		if comparisons[2].Group != "g2" || comparisons[2].Current != nil {
+			t.Errorf("%s: g2 should be missing", test.msg)
+		}
+		if strings.Join(comparisons[2].Regressions, ",") != "missing" || !Regressed(comparisons) {
+			t.Errorf("%s: missing g2 should be a regression: %v", test.msg, comparisons[2].Regressions)
+		}
+
+		var b bytes.Buffer
+		WriteComparison(&b, comparisons)
+		if !strings.Contains(b.String(), "missing") {
+			t.Errorf("%s: comparison should report missing group:\n%s", test.msg, b.String())
+		}
+		t.Log("\n" + b.String())
+	}
+}
+
+func TestCompareErrors(t *testing.T) {
+	base := testRun("g1", "select 1", 10, 10*time.Millisecond, 2*time.Millisecond)
+	current := testRun("g1", "select 1", 10, 10*time.Millisecond, 2*time.Millisecond)
+	for i := range current {
+		current[i].Err = errors.New("failed")
+	}
+	comparisons := Compare(NewRun(base), NewRun(current), 10)
+	if !Regressed(comparisons) || comparisons[0].Regressions[0] != "throughput" {
+		t.Errorf("failed queries should regress throughput: %+v", comparisons[0])
+	}
+
+	for _, test := range []struct {
+		msg            string
+		baseErrors     int
+		currentErrors  int
+		regressedError bool
+	}{
+		{msg: "no errors"},
+		{msg: "new errors", currentErrors: 1, regressedError: true},
+		{msg: "same errors", baseErrors: 10, currentErrors: 10},
+		{msg: "fewer errors", baseErrors: 10, currentErrors: 5},
+		{msg: "more errors", baseErrors: 10, currentErrors: 20, regressedError: true},
+	} {
+		base := testRun("g1", "select 1", 100, 10*time.Millisecond, 2*time.Millisecond)
+		for i := 0; i < test.baseErrors; i++ {
+			base = append(base, QueryResult{Group: "g1", Database: "db1", Query: "select 1", Start: base[0].Start, Err: errors.New("failed")})
+		}
+		current := testRun("g1", "select 1", 100, 10*time.Millisecond, 2*time.Millisecond)
+		for i := 0; i < test.currentErrors; i++ {
+			current = append(current, QueryResult{Group: "g1", Database: "db1", Query: "select 1", Start: current[0].Start, Timeout: true})
+		}
+		comparisons := Compare(NewRun(base), NewRun(current), 10)
+		regressedError := false
+		for _, r := range comparisons[0].Regressions {
+			if r == "errors" {
+				regressedError = true
+			}
+		}
+		if regressedError != test.regressedError {
+			t.Errorf("%s: error regression should be %t: %v", test.msg, test.regressedError, comparisons[0].Regressions)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v4"
+	"github.com/rorycl/pgtools/pgconnect"
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -12,10 +17,217 @@ type Config map[string]DBQueryGroupConfig
 // DBQueryGroupConfig sets out the configuration items for each group of
 // databases
 type DBQueryGroupConfig struct {
-	Databases   []string
-	Concurrency int
-	Iterations  int
-	Queries     []string
+	Databases    []DatabaseConfig
+	Targets      map[string]TargetConfig // named database servers
+	Target       string                  // default target for databases
+	Concurrency  int
+	Iterations   int
+	Queries      []QueryConfig
+	Transactions []TransactionConfig
+	Mix          string // sequential (default) or weighted
+	Protocol     string // optional protocol mode
+	Pool         *PoolConfig
+	Rate         Rate // target queries per second, 0 for no limit
+	Profile      Profile
+	Timeouts     `yaml:",inline"` // defaults for the group's queries
+	MaxErrorRate Percent          `yaml:"max_error_rate"` // 0 for no limit
+	AbortOn      []string         `yaml:"abort_on"`       // error classes ending the run
+
+	SessionConfig `yaml:",inline"` // connection setup and teardown
+}
+
+// SessionConfig sets out the run-time settings applied and the setup
+// statements run on each connection before its queries, and the
+// teardown statements run before the connection is closed, none of
+// which are timed
+type SessionConfig struct {
+	Setup    []string
+	Teardown []string
+	Settings map[string]string // run-time parameter names and values
+}
+
+// check checks the session statements and settings are not empty
+func (c SessionConfig) check() error {
+	statements := append(append([]string{}, c.Setup...), c.Teardown...)
+	for _, sql := range statements {
+		if strings.TrimSpace(sql) == "" {
+			return errors.New("empty setup or teardown statement")
+		}
+	}
+	for name := range c.Settings {
+		if name == "" {
+			return errors.New("setting has no name")
+		}
+	}
+	return nil
+}
+
+// Timeouts sets out the time limits for a query. Timeout limits the
+// time the client waits for the query, after which the query is
+// cancelled and its connection closed, and StatementTimeout sets the
+// server statement_timeout for the query. Zero values set no limit.
+type Timeouts struct {
+	Timeout          time.Duration
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+}
+
+// withDefaults returns the timeouts with unset values taken from
+// defaults
+func (t Timeouts) withDefaults(defaults Timeouts) Timeouts {
+	if t.Timeout == 0 {
+		t.Timeout = defaults.Timeout
+	}
+	if t.StatementTimeout == 0 {
+		t.StatementTimeout = defaults.StatementTimeout
+	}
+	return t
+}
+
+// check checks the timeouts are not negative
+func (t Timeouts) check() error {
+	if t.Timeout < 0 || t.StatementTimeout < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	return nil
+}
+
+// QueryConfig sets out a query and the generators for its $1..$n
+// parameters, if any. A query without parameters may be given in yaml
+// as a string. The optional name labels the query in reports in place
+// of its sql, and the weight sets how often the query is picked in a
+// weighted mix. Fetch queries read all of their result rows, as an
+// application would, rather than discarding them. Timeouts override
+// those of the query's transaction or group.
+type QueryConfig struct {
+	SQL      string
+	Name     string
+	Weight   float64
+	Fetch    bool
+	Params   []ParamConfig
+	Timeouts `yaml:",inline"`
+}
+
+// UnmarshalYAML decodes a query from a yaml string or mapping
+func (q *QueryConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		q.SQL = value.Value
+		return nil
+	}
+	type plain QueryConfig // avoid recursion
+	return value.Decode((*plain)(q))
+}
+
+// check checks the validity of the query settings
+func (q QueryConfig) check() error {
+	if q.SQL == "" {
+		return errors.New("query has no sql")
+	}
+	if q.Weight < 0 {
+		return errors.New("query weight cannot be negative")
+	}
+	if err := q.Timeouts.check(); err != nil {
+		return err
+	}
+	for i, p := range q.Params {
+		if err := p.check(); err != nil {
+			return fmt.Errorf("parameter %d: %w", i+1, err)
+		}
+	}
+	return checkPlaceholders(q.SQL, len(q.Params))
+}
+
+// TransactionConfig sets out a named script of statements run in a
+// transaction at the given isolation level, retried up to Retries times
+// on serialization failures and deadlocks. The weight sets how often
+// the transaction is picked in a weighted mix. Timeouts apply to each
+// statement, overriding those of the group.
+type TransactionConfig struct {
+	Name       string
+	Isolation  string
+	Retries    int
+	Weight     float64
+	Statements []QueryConfig
+	Timeouts   `yaml:",inline"`
+}
+
+// isolationLevels are the supported transaction isolation levels
+var isolationLevels = map[string]pgx.TxIsoLevel{
+	"":                 "",
+	"read uncommitted": pgx.ReadUncommitted,
+	"read committed":   pgx.ReadCommitted,
+	"repeatable read":  pgx.RepeatableRead,
+	"serializable":     pgx.Serializable,
+}
+
+// check checks the validity of the transaction settings
+func (t TransactionConfig) check() error {
+	if t.Name == "" {
+		return errors.New("transaction has no name")
+	}
+	if _, ok := isolationLevels[strings.ToLower(t.Isolation)]; !ok {
+		return fmt.Errorf("transaction %s has unknown isolation level %q", t.Name, t.Isolation)
+	}
+	if t.Retries < 0 {
+		return fmt.Errorf("transaction %s retries cannot be negative", t.Name)
+	}
+	if t.Weight < 0 {
+		return fmt.Errorf("transaction %s weight cannot be negative", t.Name)
+	}
+	if err := t.Timeouts.check(); err != nil {
+		return fmt.Errorf("transaction %s %w", t.Name, err)
+	}
+	if len(t.Statements) == 0 {
+		return fmt.Errorf("transaction %s has no statements", t.Name)
+	}
+	for i, s := range t.Statements {
+		if err := s.check(); err != nil {
+			return fmt.Errorf("transaction %s statement %d: %w", t.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// databases returns the group's databases, setting the target of those
+// without one to the group default target
+func (g DBQueryGroupConfig) databases() []DatabaseConfig {
+	databases := []DatabaseConfig{}
+	for _, d := range g.Databases {
+		if d.Target == "" {
+			d.Target = g.Target
+		}
+		databases = append(databases, d)
+	}
+	return databases
+}
+
+// peakConcurrency returns the highest number of workers the group runs,
+// following its load profile if any
+func (g DBQueryGroupConfig) peakConcurrency() int {
+	return g.Profile.peak(g.Concurrency)
+}
+
+// weights returns the weights of the group's queries followed by those
+// of its transactions
+func (g DBQueryGroupConfig) weights() []float64 {
+	weights := []float64{}
+	for _, q := range g.Queries {
+		weights = append(weights, q.Weight)
+	}
+	for _, t := range g.Transactions {
+		weights = append(weights, t.Weight)
+	}
+	return weights
+}
+
+// PoolConfig sets out the connection pool settings for a group. If a
+// group has a pool configuration its queries are run through a
+// connection pool shared by the group for each database, otherwise a
+// new connection is made for each database task.
+type PoolConfig struct {
+	MinConns        int32         `yaml:"min_conns"`
+	MaxConns        int32         `yaml:"max_conns"` // defaults to concurrency
+	MaxConnLifetime time.Duration `yaml:"max_conn_lifetime"`
+	MaxConnIdleTime time.Duration `yaml:"max_conn_idle_time"`
 }
 
 // LoadYaml loads a yaml file and returns a Settings structure
@@ -39,9 +251,70 @@ func (c Config) check() error {
 		if v.Iterations == 0 {
 			return fmt.Errorf("group %s requires 1 or more iterations", k)
 		}
-		if len(v.Queries) == 0 {
+		if len(v.Queries) == 0 && len(v.Transactions) == 0 {
 			return fmt.Errorf("group %s has no queries defined", k)
 		}
+		for name, t := range v.Targets {
+			if _, err := t.settings(pgconnect.Settings{}); err != nil {
+				return fmt.Errorf("group %s target %s: %w", k, name, err)
+			}
+		}
+		if _, ok := v.Targets[v.Target]; v.Target != "" && !ok {
+			return fmt.Errorf("group %s target %s is not defined", k, v.Target)
+		}
+		for _, d := range v.Databases {
+			if d.Name == "" {
+				return fmt.Errorf("group %s has a database with no name", k)
+			}
+			if _, ok := v.Targets[d.Target]; d.Target != "" && !ok {
+				return fmt.Errorf("group %s database %s target %s is not defined", k, d.Name, d.Target)
+			}
+		}
+		if _, ok := protocols[v.Protocol]; v.Protocol != "" && !ok {
+			return fmt.Errorf("group %s has unknown protocol %q", k, v.Protocol)
+		}
+		switch v.Mix {
+		case "", "sequential", "weighted":
+		default:
+			return fmt.Errorf("group %s has unknown mix %q", k, v.Mix)
+		}
+		for i, q := range v.Queries {
+			if err := q.check(); err != nil {
+				return fmt.Errorf("group %s query %d: %w", k, i+1, err)
+			}
+		}
+		names := map[string]bool{}
+		for _, t := range v.Transactions {
+			if err := t.check(); err != nil {
+				return fmt.Errorf("group %s: %w", k, err)
+			}
+			if names[t.Name] {
+				return fmt.Errorf("group %s has more than one transaction %s", k, t.Name)
+			}
+			names[t.Name] = true
+		}
+		if err := v.Timeouts.check(); err != nil {
+			return fmt.Errorf("group %s %w", k, err)
+		}
+		if err := v.SessionConfig.check(); err != nil {
+			return fmt.Errorf("group %s %w", k, err)
+		}
+		for _, c := range v.AbortOn {
+			if !validErrorClass(c) {
+				return fmt.Errorf("group %s has unknown abort_on error class %q", k, c)
+			}
+		}
+		if err := v.Profile.check(); err != nil {
+			return fmt.Errorf("group %s: %w", k, err)
+		}
+		if p := v.Pool; p != nil {
+			if p.MinConns < 0 || p.MaxConns < 0 {
+				return fmt.Errorf("group %s pool connections cannot be negative", k)
+			}
+			if p.MaxConns > 0 && p.MinConns > p.MaxConns {
+				return fmt.Errorf("group %s pool min_conns exceeds max_conns", k)
+			}
+		}
 	}
 	return nil
 }
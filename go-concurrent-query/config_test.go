@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testSettings = "config.yaml"
@@ -62,3 +64,391 @@ typeerror:
 		t.Error("yaml should error with no queries")
 	}
 }
+
+// TestPoolConfig tests pool configuration settings
+func TestPoolConfig(t *testing.T) {
+
+	inlineYaml := `
+---
+pooled:
+  databases: [db1, db2]
+  concurrency: 4
+  iterations: 3
+  queries: [select 1]
+  pool:
+    min_conns: 2
+    max_conns: 4
+    max_conn_lifetime: 5m
+    max_conn_idle_time: 30s
+unpooled:
+  databases: [db1, db2]
+  concurrency: 4
+  iterations: 3
+  queries: [select 1]
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	p := y["pooled"].Pool
+	if p == nil {
+		t.Fatal("pooled group has no pool config")
+	}
+	if p.MinConns != 2 || p.MaxConns != 4 {
+		t.Errorf("unexpected pool connections %+v", p)
+	}
+	if p.MaxConnLifetime != 5*time.Minute || p.MaxConnIdleTime != 30*time.Second {
+		t.Errorf("unexpected pool durations %+v", p)
+	}
+	if y["unpooled"].Pool != nil {
+		t.Error("unpooled group should have no pool config")
+	}
+
+	invalidYaml := strings.Replace(inlineYaml, "min_conns: 2", "min_conns: 5", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with min_conns exceeding max_conns")
+	}
+
+	// a pool may be smaller than the peak number of workers
+	profileYaml := strings.Replace(inlineYaml, "unpooled:", `  profile:
+    - {duration: 1m, concurrency: 8, ramp: linear}
+unpooled:`, 1)
+	y, err = LoadYaml([]byte(profileYaml))
+	if err != nil {
+		t.Fatalf("max_conns below the profile peak should be valid: %s", err)
+	}
+	if peak := y["pooled"].peakConcurrency(); peak != 8 {
+		t.Errorf("peak concurrency %d should be 8", peak)
+	}
+}
+
+// TestParameterisedQueries tests queries with parameter generators
+func TestParameterisedQueries(t *testing.T) {
+
+	inlineYaml := `
+---
+params:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  queries:
+    - select 1
+    - sql: select * from accounts where id = $1 and region = $2
+      params:
+        - {type: zipf, min: 1, max: 100000}
+        - {type: choice, values: [north, south]}
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	queries := y["params"].Queries
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(queries))
+	}
+	if queries[0].SQL != "select 1" || len(queries[0].Params) != 0 {
+		t.Errorf("unexpected first query %+v", queries[0])
+	}
+	if len(queries[1].Params) != 2 || queries[1].Params[0].Max != 100000 {
+		t.Errorf("unexpected second query %+v", queries[1])
+	}
+
+	invalidYaml := strings.Replace(inlineYaml, "region = $2", "region = $3", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with mismatched placeholders")
+	}
+
+	invalidYaml = strings.Replace(inlineYaml, "- select 1", "- select * from accounts where id = $1", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with placeholders but no parameters")
+	}
+
+	validYaml := strings.Replace(inlineYaml, "- select 1", `- select '$5 off' -- $1`, 1)
+	if _, err := LoadYaml([]byte(validYaml)); err != nil {
+		t.Errorf("quoted placeholders should be ignored: %s", err)
+	}
+}
+
+// TestTransactions tests transaction scripts
+func TestTransactions(t *testing.T) {
+
+	inlineYaml := `
+---
+tx:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  transactions:
+    - name: transfer
+      isolation: serializable
+      retries: 3
+      statements:
+        - sql: update accounts set balance = balance - $1 where id = 1
+          params: [{type: int, min: 1, max: 10}]
+        - update accounts set balance = balance + 1 where id = 2
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	transactions := y["tx"].Transactions
+	if len(transactions) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(transactions))
+	}
+	tx := transactions[0]
+	if tx.Name != "transfer" || tx.Isolation != "serializable" || tx.Retries != 3 {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+	if len(tx.Statements) != 2 {
+		t.Errorf("expected 2 statements, got %d", len(tx.Statements))
+	}
+
+	for _, invalid := range []struct{ from, to string }{
+		{"isolation: serializable", "isolation: snapshot"},
+		{"name: transfer", "name: ''"},
+		{"retries: 3", "retries: -1"},
+	} {
+		invalidYaml := strings.Replace(inlineYaml, invalid.from, invalid.to, 1)
+		if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+			t.Errorf("yaml should error with %s", invalid.to)
+		}
+	}
+}
+
+// TestTimeouts tests group, transaction and query timeouts, and their
+// defaults
+func TestTimeouts(t *testing.T) {
+
+	inlineYaml := `
+---
+timeouts:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  timeout: 10s
+  statement_timeout: 5s
+  queries:
+    - select 1
+    - sql: select pg_sleep(1)
+      statement_timeout: 500ms
+  transactions:
+    - name: tx
+      timeout: 20s
+      statements:
+        - select 2
+        - sql: select 3
+          timeout: 1s
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	g := y["timeouts"]
+	if g.Timeout != 10*time.Second || g.StatementTimeout != 5*time.Second {
+		t.Errorf("unexpected group timeouts %+v", g.Timeouts)
+	}
+
+	queries, err := NewQueries(g.Queries, g.Timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions, err := NewTransactions(g.Transactions, g.Timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		got    Timeouts
+		expect Timeouts
+	}{
+		{queries[0].Timeouts, Timeouts{10 * time.Second, 5 * time.Second}},
+		{queries[1].Timeouts, Timeouts{10 * time.Second, 500 * time.Millisecond}},
+		{transactions[0].Statements[0].Timeouts, Timeouts{20 * time.Second, 5 * time.Second}},
+		{transactions[0].Statements[1].Timeouts, Timeouts{time.Second, 5 * time.Second}},
+	} {
+		if tt.got != tt.expect {
+			t.Errorf("test %d got %+v expected %+v", i, tt.got, tt.expect)
+		}
+	}
+
+	for _, invalid := range []struct{ from, to string }{
+		{"  timeout: 10s", "  timeout: -10s"},
+		{"statement_timeout: 500ms", "statement_timeout: -1s"},
+		{"timeout: 20s", "timeout: -1s"},
+		{"timeout: 1s", "timeout: x"},
+	} {
+		invalidYaml := strings.Replace(inlineYaml, invalid.from, invalid.to, 1)
+		if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+			t.Errorf("yaml should error with %s", invalid.to)
+		}
+	}
+}
+
+// TestErrorLimitsConfig tests the maximum error rate and abort classes
+func TestErrorLimitsConfig(t *testing.T) {
+
+	inlineYaml := `
+---
+limits:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  queries: [select 1]
+  max_error_rate: 1.5%
+  abort_on: [connection, syntax]
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	g := y["limits"]
+	if g.MaxErrorRate != 1.5 || len(g.AbortOn) != 2 || g.AbortOn[1] != "syntax" {
+		t.Errorf("unexpected error limits %g %v", g.MaxErrorRate, g.AbortOn)
+	}
+
+	for _, invalid := range []struct{ from, to string }{
+		{"1.5%", "150%"},
+		{"syntax]", "typo]"},
+	} {
+		invalidYaml := strings.Replace(inlineYaml, invalid.from, invalid.to, 1)
+		if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+			t.Errorf("yaml should error with %s", invalid.to)
+		}
+	}
+}
+
+// TestProtocolConfig tests protocol modes
+func TestProtocolConfig(t *testing.T) {
+
+	inlineYaml := `
+---
+protocol:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  queries: [select 1]
+  protocol: describe
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	if p := y["protocol"].Protocol; p != "describe" {
+		t.Errorf("protocol %s should be describe", p)
+	}
+	invalidYaml := strings.Replace(inlineYaml, "describe", "extended", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with an unknown protocol")
+	}
+}
+
+// TestSessionConfig tests connection setup and teardown statements and
+// settings
+func TestSessionConfig(t *testing.T) {
+
+	inlineYaml := `
+---
+session:
+  databases: [db1]
+  concurrency: 1
+  iterations: 1
+  queries: [select 1]
+  settings:
+    search_path: app, public
+    work_mem: 64MB
+    enable_seqscan: off
+  setup:
+    - set role app_user
+    - create temp table scratch (id int)
+  teardown:
+    - drop table scratch
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	s := y["session"].SessionConfig
+	if len(s.Setup) != 2 || len(s.Teardown) != 1 {
+		t.Errorf("unexpected setup %v and teardown %v", s.Setup, s.Teardown)
+	}
+	if s.Settings["search_path"] != "app, public" || s.Settings["enable_seqscan"] != "off" {
+		t.Errorf("unexpected settings %v", s.Settings)
+	}
+
+	invalidYaml := strings.Replace(inlineYaml, "drop table scratch", "''", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with an empty teardown statement")
+	}
+}
+
+// TestTargets tests named database targets
+func TestTargets(t *testing.T) {
+
+	inlineYaml := `
+---
+cluster:
+  targets:
+    primary:
+      host: 10.0.0.1
+      user: app
+      password: secret
+    replica:
+      host: 10.0.0.2
+      port: 6432
+      sslmode: require
+      application_name: loadtest
+      params:
+        connect_timeout: 5
+    failover:
+      host: 10.0.0.1,10.0.0.2
+      port: 5432,6432
+      target_session_attrs: read-write
+  target: primary
+  databases:
+    - db1
+    - {name: db1, target: replica}
+  concurrency: 2
+  iterations: 1
+  queries: [select 1]
+`
+
+	y, err := LoadYaml([]byte(inlineYaml))
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	g := y["cluster"]
+	if len(g.Targets) != 3 {
+		t.Fatalf("expected 3 targets, got %d", len(g.Targets))
+	}
+	replica := g.Targets["replica"]
+	if replica.Port != "6432" || replica.SSLMode != "require" || replica.ApplicationName != "loadtest" {
+		t.Errorf("unexpected replica target %+v", replica)
+	}
+	if replica.Params["connect_timeout"] != "5" {
+		t.Errorf("unexpected replica params %+v", replica.Params)
+	}
+	failover := g.Targets["failover"]
+	if failover.Host != "10.0.0.1,10.0.0.2" || failover.Port != "5432,6432" || failover.TargetSessionAttrs != "read-write" {
+		t.Errorf("unexpected failover target %+v", failover)
+	}
+	databases := g.databases()
+	if databases[0].Target != "primary" || databases[1].Target != "replica" {
+		t.Errorf("unexpected database targets %+v", databases)
+	}
+
+	invalidYaml := strings.Replace(inlineYaml, "target: replica", "target: standby", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with an undefined target")
+	}
+
+	invalidYaml = strings.Replace(inlineYaml, "port: 5432,6432", "port: 5432,x", 1)
+	if _, err := LoadYaml([]byte(invalidYaml)); err == nil {
+		t.Error("yaml should error with an invalid target port")
+	}
+}
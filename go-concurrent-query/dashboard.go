@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// dashboardWindow is the period over which the dashboard reports
+// throughput and latency percentiles, in whole seconds
+var dashboardWindow = 10 * time.Second
+
+// dashboardLogLines is the number of recent log lines shown below the
+// dashboard table
+var dashboardLogLines = 8
+
+// clearScreen moves the cursor to the top left of the terminal and
+// clears the screen
+const clearScreen = "\x1b[H\x1b[2J"
+
+// dashSeries holds the counts and recent timings of a query group or
+// database. The timings of successful queries are recorded in a ring
+// of one second histograms covering the dashboard window.
+type dashSeries struct {
+	queries  int64
+	errors   int64 // not including timeouts
+	timeouts int64
+	window   []Histogram
+}
+
+// record records a result in the current slot of the window
+func (s *dashSeries) record(r QueryResult, slot int) {
+	s.queries++
+	switch {
+	case r.Timeout:
+		s.timeouts++
+	case r.Err != nil:
+		s.errors++
+	default:
+		s.window[slot].Record(r.Duration)
+	}
+}
+
+// recent returns the timings recorded over the window
+func (s *dashSeries) recent() *Histogram {
+	h := &Histogram{}
+	for i := range s.window {
+		h.Merge(&s.window[i])
+	}
+	return h
+}
+
+// Dashboard is a live terminal display of the throughput, in-flight
+// queries, errors and recent latency percentiles of each query group
+// and database, redrawn every second. Log output written to the
+// Dashboard is shown below the table. It is safe for concurrent use.
+type Dashboard struct {
+	mu        sync.Mutex
+	start     time.Time
+	duration  time.Duration // run duration, 0 if not limited
+	inFlight  *InFlight
+	groups    map[string]*dashSeries
+	databases map[metricKey]*dashSeries
+	slot      int // current slot of the series windows
+	logLines  []string
+}
+
+// NewDashboard returns a new Dashboard for a run of the given duration
+// starting now, reporting in-flight queries from inFlight
+func NewDashboard(inFlight *InFlight, duration time.Duration) *Dashboard {
+	return &Dashboard{
+		start:     time.Now(),
+		duration:  duration,
+		inFlight:  inFlight,
+		groups:    map[string]*dashSeries{},
+		databases: map[metricKey]*dashSeries{},
+	}
+}
+
+// series returns s, or a new series if s is nil
+func (d *Dashboard) series(s *dashSeries) *dashSeries {
+	if s == nil {
+		s = &dashSeries{window: make([]Histogram, int(dashboardWindow/time.Second))}
+	}
+	return s
+}
+
+// Record records a query result. Statements in transactions are not
+// recorded, being included in their transaction.
+func (d *Dashboard) Record(r QueryResult) {
+	if r.IsStatement() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.groups[r.Group] = d.series(d.groups[r.Group])
+	d.groups[r.Group].record(r, d.slot)
+	k := metricKey{r.Group, r.Database}
+	d.databases[k] = d.series(d.databases[k])
+	d.databases[k].record(r, d.slot)
+}
+
+// RecordError records a query group error which is not associated with
+// a database
+func (d *Dashboard) RecordError(group string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.groups[group] = d.series(d.groups[group])
+	d.groups[group].errors++
+}
+
+// Write records a log line to show below the table, so that the
+// Dashboard can be used as the log output
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.logLines = append(d.logLines, line)
+	}
+	if len(d.logLines) > dashboardLogLines {
+		d.logLines = d.logLines[len(d.logLines)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// tick moves the series windows on by a second, discarding the oldest
+// timings
+func (d *Dashboard) tick() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.slot = (d.slot + 1) % int(dashboardWindow/time.Second)
+	for _, s := range d.groups {
+		s.window[d.slot] = Histogram{}
+	}
+	for _, s := range d.databases {
+		s.window[d.slot] = Histogram{}
+	}
+}
+
+// Draw writes the dashboard to w as at now
+func (d *Dashboard) Draw(w io.Writer, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elapsed := now.Sub(d.start)
+	progress := fmt.Sprintf("elapsed %s", elapsed.Round(time.Second))
+	if d.duration > 0 {
+		progress += fmt.Sprintf(" of %s", d.duration)
+	}
+	fmt.Fprintf(w, "%s, throughput and latency over the last %s\n\n", progress, dashboardWindow)
+
+	// the window only covers the elapsed time early in the run
+	window := dashboardWindow.Seconds()
+	if e := elapsed.Seconds(); e < window {
+		window = e
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	var inFlight map[metricKey]int64
+	if d.inFlight != nil {
+		inFlight = d.inFlight.snapshot()
+	}
+	groupInFlight := map[string]int64{}
+	for k, n := range inFlight {
+		groupInFlight[k.group] += n
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "group\tdatabase\tqps\tin-flight\tqueries\terrors\ttimeouts\tp50\tp95\tp99\t")
+	row := func(group, name string, s *dashSeries, inFlight int64) {
+		h := s.recent()
+		fmt.Fprintf(
+			tw, "%s\t%s\t%.1f\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t\n",
+			group, name, float64(h.Count())/window, inFlight, s.queries, s.errors, s.timeouts,
+			millis(h.Percentile(50)), millis(h.Percentile(95)), millis(h.Percentile(99)),
+		)
+	}
+
+	groups := []string{}
+	for g := range d.groups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	dbKeys := []metricKey{}
+	for k := range d.databases {
+		dbKeys = append(dbKeys, k)
+	}
+	sortMetricKeys(dbKeys)
+
+	for _, g := range groups {
+		row(g, "(all)", d.groups[g], groupInFlight[g])
+		for _, k := range dbKeys {
+			if k.group == g {
+				row(g, k.name, d.databases[k], inFlight[k])
+			}
+		}
+	}
+	tw.Flush()
+
+	if len(d.logLines) > 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(d.logLines, "\n"))
+	}
+}
+
+// Run redraws the dashboard on w every second until stop is closed,
+// when it is drawn a final time
+func (d *Dashboard) Run(stop <-chan struct{}, w io.Writer) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var b bytes.Buffer
+	draw := func() {
+		b.Reset()
+		b.WriteString(clearScreen)
+		d.Draw(&b, time.Now())
+		w.Write(b.Bytes())
+	}
+	draw()
+	for {
+		select {
+		case <-stop:
+			draw()
+			return
+		case <-ticker.C:
+			d.tick()
+			draw()
+		}
+	}
+}
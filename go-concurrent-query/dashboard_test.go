@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDashboard checks the dashboard counts and rolling window
+func TestDashboard(t *testing.T) {
+	inFlight := NewInFlight()
+	inFlight.Begin("g1", "db1")
+	d := NewDashboard(inFlight, time.Minute)
+
+	for i := 1; i <= 10; i++ {
+		d.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: time.Duration(i) * time.Millisecond})
+	}
+	d.Record(QueryResult{Group: "g1", Database: "db2", Query: "select 1", Err: errors.New("failed")})
+	d.Record(QueryResult{Group: "g1", Database: "db2", Query: "select 1", Err: errors.New("timeout"), Timeout: true})
+	d.Record(QueryResult{Group: "g1", Database: "db1", Transaction: "tx", Statement: 1, Duration: time.Second})
+	d.RecordError("g2")
+
+	logger := log.New(d, "", 0)
+	logger.Println("first line")
+	logger.Println("second line")
+
+	var b bytes.Buffer
+	d.Draw(&b, d.start.Add(5*time.Second))
+	got := b.String()
+	t.Log("\n" + got)
+
+	for _, expect := range []string{
+		"elapsed 5s of 1m0s",
+		"g1     (all)     2.0  1          12       1       1         5.003",
+		"g1     db1       2.0  1          10       0       0         5.003",
+		"g1     db2       0.0  0          2        1       1",
+		"g2     (all)     0.0  0          0        1       0",
+		"first line\nsecond line",
+	} {
+		if !strings.Contains(got, expect) {
+			t.Errorf("dashboard does not contain %q", expect)
+		}
+	}
+
+	// timings leave the window after it has passed, but counts remain
+	for i := 0; i < int(dashboardWindow/time.Second); i++ {
+		d.tick()
+	}
+	b.Reset()
+	d.Draw(&b, d.start.Add(time.Minute))
+	if !strings.Contains(b.String(), "g1     db1       0.0  1          10") {
+		t.Errorf("timings should have left the window:\n%s", b.String())
+	}
+}
+
+// TestDashboardLogLines checks only the most recent log lines are kept
+func TestDashboardLogLines(t *testing.T) {
+	d := NewDashboard(nil, 0)
+	for i := 0; i < dashboardLogLines+2; i++ {
+		d.Write([]byte("line\n"))
+	}
+	if len(d.logLines) != dashboardLogLines {
+		t.Errorf("got %d log lines, expected %d", len(d.logLines), dashboardLogLines)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// error classes, by which query errors are counted and limited
+const (
+	classConnection      = "connection"
+	classTimeout         = "timeout"
+	classCancelled       = "cancelled"
+	classSerialization   = "serialization"
+	classDeadlock        = "deadlock"
+	classUniqueViolation = "unique_violation"
+	classSyntax          = "syntax"
+	classOther           = "other"
+)
+
+// errorClasses are the error classes in reporting order
+var errorClasses = []string{
+	classConnection, classTimeout, classCancelled, classSerialization,
+	classDeadlock, classUniqueViolation, classSyntax, classOther,
+}
+
+// validErrorClass reports whether class is a known error class
+func validErrorClass(class string) bool {
+	for _, c := range errorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorClass classifies the error of a result, returning an empty
+// string if there is no error. Classes are determined from the SQLSTATE
+// code of postgresql errors; syntax includes the other errors of class
+// 42, such as undefined tables and columns, and connection includes
+// failures to connect, network errors and server shutdowns. Session
+// setup errors are classified like query errors.
+func (r QueryResult) ErrorClass() string {
+	if r.Err == nil {
+		return ""
+	}
+	if r.Timeout {
+		return classTimeout
+	}
+	if r.QueryIndex < 0 && !isSetupError(r.Err) {
+		return classConnection
+	}
+	switch code := r.SQLState; {
+	case code == "40001":
+		return classSerialization
+	case code == "40P01":
+		return classDeadlock
+	case code == "23505":
+		return classUniqueViolation
+	case code == queryCanceled:
+		return classCancelled
+	case strings.HasPrefix(code, "42"):
+		return classSyntax
+	case strings.HasPrefix(code, "08"), code == "57P01", code == "57P02", code == "57P03":
+		return classConnection
+	case code != "":
+		return classOther
+	}
+	return errorClass(r.Err)
+}
+
+// errorClass classifies an error which is not a postgresql error
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return classCancelled
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return classConnection
+	}
+	return classOther
+}
+
+// Percent is a percentage, set in yaml as a number with an optional
+// percent sign, eg "1%" or 0.5
+type Percent float64
+
+// UnmarshalYAML parses a percentage from a yaml scalar
+func (p *Percent) UnmarshalYAML(value *yaml.Node) error {
+	s := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value.Value), "%"))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 100 {
+		return fmt.Errorf("invalid percentage %q", value.Value)
+	}
+	*p = Percent(f)
+	return nil
+}
+
+// errorRateMinResults is the number of results required before the
+// error rate of a group is checked against its maximum, so that a run
+// is not ended by an error among its first few queries
+var errorRateMinResults int64 = 100
+
+// ErrorLimits ends the run of a query group when an error of one of
+// the abort classes occurs or when the rate of errors, including
+// timeouts, exceeds a maximum. A nil ErrorLimits sets no limits. It is
+// safe for concurrent use.
+type ErrorLimits struct {
+	mu           sync.Mutex
+	maxErrorRate Percent
+	abortOn      map[string]bool
+	results      int64
+	errors       int64
+}
+
+// NewErrorLimits returns the ErrorLimits for a maximum error rate and
+// abort classes, or nil if neither is set
+func NewErrorLimits(maxErrorRate Percent, abortOn []string) *ErrorLimits {
+	if maxErrorRate == 0 && len(abortOn) == 0 {
+		return nil
+	}
+	l := &ErrorLimits{maxErrorRate: maxErrorRate, abortOn: map[string]bool{}}
+	for _, c := range abortOn {
+		l.abortOn[c] = true
+	}
+	return l
+}
+
+// Check records a result, returning an error describing the limit
+// exceeded, if any. Statements in transactions are not counted, being
+// included in their transaction.
+func (l *ErrorLimits) Check(r QueryResult) error {
+	if l == nil || r.IsStatement() {
+		return nil
+	}
+	return l.check(r.ErrorClass())
+}
+
+// CheckError records a query group error which is not associated with
+// a query, classed as other
+func (l *ErrorLimits) CheckError() error {
+	if l == nil {
+		return nil
+	}
+	return l.check(classOther)
+}
+
+// check records the outcome of a query with an error class, or an empty
+// class for a successful query, and checks the limits
+func (l *ErrorLimits) check(class string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.results++
+	if class == "" {
+		return nil
+	}
+	l.errors++
+	if l.abortOn[class] {
+		return fmt.Errorf("%s error", class)
+	}
+	rate := 100 * float64(l.errors) / float64(l.results)
+	if l.maxErrorRate > 0 && l.results >= errorRateMinResults && rate > float64(l.maxErrorRate) {
+		return fmt.Errorf("error rate %.2f%% exceeds %g%%", rate, float64(l.maxErrorRate))
+	}
+	return nil
+}
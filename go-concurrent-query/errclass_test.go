@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestErrorClass(t *testing.T) {
+	failed := errors.New("failed")
+	for i, test := range []struct {
+		result QueryResult
+		expect string
+	}{
+		{QueryResult{}, ""},
+		{QueryResult{QueryIndex: -1, Err: failed}, "connection"},
+		{QueryResult{QueryIndex: -1, Err: &SetupError{failed}, SQLState: "42601"}, "syntax"},
+		{QueryResult{QueryIndex: -1, Err: &SetupError{failed}, SQLState: "22023"}, "other"},
+		{QueryResult{QueryIndex: -1, Err: &SetupError{io.EOF}}, "connection"},
+		{QueryResult{Err: failed, SQLState: "57014", Timeout: true}, "timeout"},
+		{QueryResult{Err: failed, Timeout: true}, "timeout"},
+		{QueryResult{Err: failed, SQLState: "57014"}, "cancelled"},
+		{QueryResult{Err: failed, SQLState: "40001"}, "serialization"},
+		{QueryResult{Err: failed, SQLState: "40P01"}, "deadlock"},
+		{QueryResult{Err: failed, SQLState: "23505"}, "unique_violation"},
+		{QueryResult{Err: failed, SQLState: "42601"}, "syntax"},
+		{QueryResult{Err: failed, SQLState: "42P01"}, "syntax"},
+		{QueryResult{Err: failed, SQLState: "08006"}, "connection"},
+		{QueryResult{Err: failed, SQLState: "57P01"}, "connection"},
+		{QueryResult{Err: failed, SQLState: "22012"}, "other"},
+		{QueryResult{Err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF)}, "connection"},
+		{QueryResult{Err: context.Canceled}, "cancelled"},
+		{QueryResult{Err: failed}, "other"},
+	} {
+		if got := test.result.ErrorClass(); got != test.expect {
+			t.Errorf("test %d got %q expected %q", i, got, test.expect)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	for _, test := range []struct {
+		yaml   string
+		expect Percent
+		ok     bool
+	}{
+		{"1%", 1, true},
+		{"0.5 %", 0.5, true},
+		{"2", 2, true},
+		{"101%", 0, false},
+		{"-1%", 0, false},
+		{"x", 0, false},
+	} {
+		var p Percent
+		err := yaml.Unmarshal([]byte(test.yaml), &p)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: unexpected error %v", test.yaml, err)
+			continue
+		}
+		if p != test.expect {
+			t.Errorf("%s: got %g expected %g", test.yaml, p, test.expect)
+		}
+	}
+}
+
+func TestErrorLimits(t *testing.T) {
+	defer func(n int64) { errorRateMinResults = n }(errorRateMinResults)
+	errorRateMinResults = 10
+
+	if NewErrorLimits(0, nil) != nil {
+		t.Error("limits without settings should be nil")
+	}
+	var none *ErrorLimits
+	if err := none.Check(QueryResult{Err: errors.New("x")}); err != nil {
+		t.Errorf("nil limits should not fail: %s", err)
+	}
+
+	// abort on a class, ignoring statements and other classes
+	l := NewErrorLimits(0, []string{"syntax"})
+	syntax := QueryResult{Err: errors.New("x"), SQLState: "42601"}
+	if err := l.Check(QueryResult{Err: errors.New("x"), SQLState: "23505"}); err != nil {
+		t.Errorf("unique violation should not abort: %s", err)
+	}
+	statement := syntax
+	statement.Transaction, statement.Statement = "tx", 1
+	if err := l.Check(statement); err != nil {
+		t.Errorf("statement should not abort: %s", err)
+	}
+	if err := l.Check(syntax); err == nil {
+		t.Error("syntax error should abort")
+	}
+
+	// the error rate is checked after the minimum number of results
+	l = NewErrorLimits(10, nil)
+	for i := 0; i < 8; i++ {
+		if err := l.Check(QueryResult{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.CheckError(); err != nil {
+		t.Errorf("error rate should not be checked before 10 results: %s", err)
+	}
+	if err := l.Check(QueryResult{Err: errors.New("x"), Timeout: true}); err == nil {
+		t.Error("error rate of 20% should exceed 10%")
+	} else {
+		t.Log(err)
+	}
+}
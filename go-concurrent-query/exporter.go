@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricPrefix prefixes the names of all exported metrics
+const metricPrefix = "concurrent_query_"
+
+// latencyBuckets are the upper bounds in seconds of the exported
+// latency histogram buckets
+var latencyBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// InFlight counts the queries in progress for each query group and
+// database. A nil InFlight ignores all calls. It is safe for concurrent
+// use.
+type InFlight struct {
+	mu     sync.Mutex
+	counts map[metricKey]int64
+}
+
+// NewInFlight returns a new InFlight
+func NewInFlight() *InFlight {
+	return &InFlight{counts: map[metricKey]int64{}}
+}
+
+// Begin marks the start of a query
+func (f *InFlight) Begin(group, db string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[metricKey{group, db}]++
+}
+
+// End marks the end of a query
+func (f *InFlight) End(group, db string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[metricKey{group, db}]--
+}
+
+// snapshot returns a copy of the current counts
+func (f *InFlight) snapshot() map[metricKey]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := map[metricKey]int64{}
+	for k, v := range f.counts {
+		s[k] = v
+	}
+	return s
+}
+
+// promSeries holds the exported counters and latency histogram for a
+// query group and database
+type promSeries struct {
+	queries  int64
+	errors   map[string]int64 // by sqlstate
+	timeouts int64            // not included in errors
+	buckets  []int64          // counts per latencyBuckets bound
+	count    int64
+	sum      float64
+}
+
+// Exporter exposes query metrics in the Prometheus text format. It is
+// safe for concurrent use.
+type Exporter struct {
+	mu       sync.Mutex
+	inFlight *InFlight
+	series   map[metricKey]*promSeries
+}
+
+// NewExporter returns a new Exporter reporting in-flight queries from
+// inFlight
+func NewExporter(inFlight *InFlight) *Exporter {
+	return &Exporter{
+		inFlight: inFlight,
+		series:   map[metricKey]*promSeries{},
+	}
+}
+
+// get returns the series for a group and database, creating it if
+// necessary
+func (e *Exporter) get(group, db string) *promSeries {
+	k := metricKey{group, db}
+	s, ok := e.series[k]
+	if !ok {
+		s = &promSeries{
+			errors:  map[string]int64{},
+			buckets: make([]int64, len(latencyBuckets)),
+		}
+		e.series[k] = s
+	}
+	return s
+}
+
+// Record records a query result. Statements in transactions are not
+// recorded, being included in their transaction.
+func (e *Exporter) Record(r QueryResult) {
+	if r.IsStatement() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := e.get(r.Group, r.Database)
+	s.queries++
+	if r.Timeout {
+		s.timeouts++
+		return
+	}
+	if r.Err != nil {
+		s.errors[r.SQLState]++
+		return
+	}
+	secs := r.Duration.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += secs
+}
+
+// RecordError records a query group error which is not associated with
+// a database
+func (e *Exporter) RecordError(group string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.get(group, "").errors[""]++
+}
+
+// promLabels formats prometheus labels from name, value pairs
+func promLabels(pairs ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// promFloat formats a float for the prometheus text format
+func promFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format
+func (e *Exporter) WriteMetrics(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	keys := []metricKey{}
+	for k := range e.series {
+		keys = append(keys, k)
+	}
+	sortMetricKeys(keys)
+
+	fmt.Fprintf(w, "# HELP %squeries_total Queries executed.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %squeries_total counter\n", metricPrefix)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%squeries_total%s %d\n",
+			metricPrefix, promLabels("group", k.group, "db", k.name), e.series[k].queries)
+	}
+
+	fmt.Fprintf(w, "# HELP %serrors_total Query errors by SQLSTATE.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %serrors_total counter\n", metricPrefix)
+	for _, k := range keys {
+		states := []string{}
+		for state := range e.series[k].errors {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			fmt.Fprintf(w, "%serrors_total%s %d\n",
+				metricPrefix, promLabels("group", k.group, "db", k.name, "sqlstate", state),
+				e.series[k].errors[state])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %stimeouts_total Queries exceeding their timeouts.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %stimeouts_total counter\n", metricPrefix)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%stimeouts_total%s %d\n",
+			metricPrefix, promLabels("group", k.group, "db", k.name), e.series[k].timeouts)
+	}
+
+	fmt.Fprintf(w, "# HELP %sin_flight Queries in progress.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %sin_flight gauge\n", metricPrefix)
+	if e.inFlight != nil {
+		inFlight := e.inFlight.snapshot()
+		flightKeys := []metricKey{}
+		for k := range inFlight {
+			flightKeys = append(flightKeys, k)
+		}
+		sortMetricKeys(flightKeys)
+		for _, k := range flightKeys {
+			fmt.Fprintf(w, "%sin_flight%s %d\n",
+				metricPrefix, promLabels("group", k.group, "db", k.name), inFlight[k])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %sduration_seconds Query latency.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %sduration_seconds histogram\n", metricPrefix)
+	for _, k := range keys {
+		s := e.series[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "%sduration_seconds_bucket%s %d\n",
+				metricPrefix, promLabels("group", k.group, "db", k.name, "le", promFloat(le)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%sduration_seconds_bucket%s %d\n",
+			metricPrefix, promLabels("group", k.group, "db", k.name, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%sduration_seconds_sum%s %s\n",
+			metricPrefix, promLabels("group", k.group, "db", k.name), promFloat(s.sum))
+		fmt.Fprintf(w, "%sduration_seconds_count%s %d\n",
+			metricPrefix, promLabels("group", k.group, "db", k.name), s.count)
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteMetrics(w)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExporterScrape scrapes an Exporter over http
+func TestExporterScrape(t *testing.T) {
+	inFlight := NewInFlight()
+	exporter := NewExporter(inFlight)
+
+	inFlight.Begin("g1", "db1")
+	inFlight.Begin("g1", "db1")
+	inFlight.End("g1", "db1")
+	exporter.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: 3 * time.Millisecond})
+	exporter.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: 2 * time.Second})
+	exporter.Record(QueryResult{Group: "g1", Database: "db1", Query: "select x", Err: errors.New("x"), SQLState: "42703"})
+	exporter.Record(QueryResult{Group: "g1", Database: "db1", Query: "select pg_sleep(10)", Err: errors.New("timeout"), SQLState: "57014", Timeout: true})
+	exporter.RecordError("g2")
+
+	server := httptest.NewServer(exporter)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+
+	for _, line := range []string{
+		`concurrent_query_queries_total{group="g1",db="db1"} 4`,
+		`concurrent_query_errors_total{group="g1",db="db1",sqlstate="42703"} 1`,
+		`concurrent_query_errors_total{group="g2",db="",sqlstate=""} 1`,
+		`concurrent_query_timeouts_total{group="g1",db="db1"} 1`,
+		`concurrent_query_in_flight{group="g1",db="db1"} 1`,
+		`concurrent_query_duration_seconds_bucket{group="g1",db="db1",le="0.001"} 0`,
+		`concurrent_query_duration_seconds_bucket{group="g1",db="db1",le="0.005"} 1`,
+		`concurrent_query_duration_seconds_bucket{group="g1",db="db1",le="2.5"} 2`,
+		`concurrent_query_duration_seconds_bucket{group="g1",db="db1",le="+Inf"} 2`,
+		`concurrent_query_duration_seconds_sum{group="g1",db="db1"} 2.003`,
+		`concurrent_query_duration_seconds_count{group="g1",db="db1"} 2`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("scrape missing line %s", line)
+		}
+	}
+	if strings.Contains(string(body), `sqlstate="57014"`) {
+		t.Error("timeouts should not be counted as errors")
+	}
+	t.Log("\n" + string(body))
+}
+
+func TestPromLabels(t *testing.T) {
+	got := promLabels("group", `a"b`, "db", "c\\d\ne")
+	expect := `{group="a\"b",db="c\\d\ne"}`
+	if got != expect {
+		t.Errorf("got %s expected %s", got, expect)
+	}
+}
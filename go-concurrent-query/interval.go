@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IntervalReport reports the throughput, errors and latency of a query
+// group over an interval of a run
+type IntervalReport struct {
+	Group    string
+	Start    time.Time     // start of the interval
+	Elapsed  time.Duration // from the start of the run to the end of the interval
+	Interval time.Duration
+	Stats
+	Server *ServerStats // optional server statistics, see Monitor
+}
+
+// Rate returns the number of successful queries per second in the
+// interval
+func (r IntervalReport) Rate() float64 {
+	if r.Interval <= 0 {
+		return 0
+	}
+	return float64(r.Count()) / r.Interval.Seconds()
+}
+
+// String reports the interval in the manner of pgbench's progress
+// reports, with latencies in milliseconds
+func (r IntervalReport) String() string {
+	return fmt.Sprintf(
+		"progress: %.1f s, group %s: %.1f qps, lat p50 %s p95 %s p99 %s ms, %d errors, %d timeouts",
+		r.Elapsed.Seconds(), r.Group, r.Rate(),
+		millis(r.Percentile(50)), millis(r.Percentile(95)), millis(r.Percentile(99)),
+		r.Errors, r.Timeouts,
+	)
+}
+
+// ServerString reports the server statistics of the interval, if any
+func (r IntervalReport) ServerString() string {
+	if r.Server == nil {
+		return ""
+	}
+	return fmt.Sprintf("progress: %.1f s, group %s server: %s", r.Elapsed.Seconds(), r.Group, r.Server)
+}
+
+// IntervalReporter aggregates query results per group over successive
+// intervals of a run. It is safe for concurrent use.
+type IntervalReporter struct {
+	mu     sync.Mutex
+	start  time.Time // start of the run
+	from   time.Time // start of the current interval
+	groups map[string]*Stats
+}
+
+// NewIntervalReporter returns a new IntervalReporter for a run starting
+// now
+func NewIntervalReporter() *IntervalReporter {
+	now := time.Now()
+	return &IntervalReporter{start: now, from: now, groups: map[string]*Stats{}}
+}
+
+// stats returns the stats for a group in the current interval
+func (ir *IntervalReporter) stats(group string) *Stats {
+	if ir.groups[group] == nil {
+		ir.groups[group] = &Stats{}
+	}
+	return ir.groups[group]
+}
+
+// Record records a query result in the current interval. Statements in
+// transactions are not recorded, being included in their transaction.
+func (ir *IntervalReporter) Record(r QueryResult) {
+	if r.IsStatement() {
+		return
+	}
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.stats(r.Group).record(r.Duration, r.Err, r.Timeout)
+}
+
+// RecordError records a query group error which is not associated with
+// a query
+func (ir *IntervalReporter) RecordError(group string) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.stats(group).Errors++
+}
+
+// Report returns a report for each group, in name order, of the
+// interval ending at now and starts the next interval. Groups which
+// have recorded results in earlier intervals are reported even if idle.
+func (ir *IntervalReporter) Report(now time.Time) []IntervalReport {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	reports := []IntervalReport{}
+	for g, s := range ir.groups {
+		reports = append(reports, IntervalReport{
+			Group:    g,
+			Start:    ir.from,
+			Elapsed:  now.Sub(ir.start),
+			Interval: now.Sub(ir.from),
+			Stats:    *s,
+		})
+		ir.groups[g] = &Stats{}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Group < reports[j].Group })
+	ir.from = now
+	return reports
+}
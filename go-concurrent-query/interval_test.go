@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestIntervalReporter checks results are reported for the interval in
+// which they are recorded only
+func TestIntervalReporter(t *testing.T) {
+	ir := NewIntervalReporter()
+	start := ir.start
+
+	for i := 1; i <= 20; i++ {
+		ir.Record(QueryResult{Group: "g2", Query: "select 1", Duration: time.Duration(i) * time.Millisecond})
+	}
+	ir.Record(QueryResult{Group: "g2", Query: "select x", Err: errors.New("failed")})
+	ir.Record(QueryResult{Group: "g2", Query: "select pg_sleep(1)", Err: errors.New("timeout"), Timeout: true})
+	ir.Record(QueryResult{Group: "g2", Transaction: "tx", Statement: 1, Duration: time.Second})
+	ir.RecordError("g1")
+
+	reports := ir.Report(start.Add(10 * time.Second))
+	if len(reports) != 2 || reports[0].Group != "g1" || reports[1].Group != "g2" {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+	if reports[0].Errors != 1 || reports[0].Count() != 0 {
+		t.Errorf("g1 should have 1 error and no queries: %s", reports[0])
+	}
+	g2 := reports[1]
+	if g2.Count() != 20 || g2.Errors != 1 || g2.Timeouts != 1 || g2.Rate() != 2 {
+		t.Errorf("g2 unexpected counts: %s", g2)
+	}
+	expect := "progress: 10.0 s, group g2: 2.0 qps, lat p50 10.007 p95 19.007 p99 20.000 ms, 1 errors, 1 timeouts"
+	if g2.String() != expect {
+		t.Errorf("got %q expected %q", g2, expect)
+	}
+
+	// the next interval starts empty
+	ir.Record(QueryResult{Group: "g2", Query: "select 1", Duration: time.Millisecond})
+	reports = ir.Report(start.Add(15 * time.Second))
+	g2 = reports[1]
+	if !g2.Start.Equal(start.Add(10*time.Second)) || g2.Interval != 5*time.Second || g2.Elapsed != 15*time.Second {
+		t.Errorf("unexpected interval %s to %s", g2.Start, g2.Interval)
+	}
+	if g2.Count() != 1 || g2.Errors != 0 || !strings.Contains(g2.String(), "0.2 qps") {
+		t.Errorf("g2 unexpected second interval: %s", g2)
+	}
+
+	// server statistics are reported only if sampled
+	if g2.ServerString() != "" {
+		t.Errorf("unexpected server report %q", g2.ServerString())
+	}
+	g2.Server = newServerStats()
+	if s := g2.ServerString(); !strings.HasPrefix(s, "progress: 15.0 s, group g2 server: sessions active 0.0") {
+		t.Errorf("unexpected server report %q", s)
+	}
+}
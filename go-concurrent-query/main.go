@@ -12,13 +12,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
 
+	// compare saved results, if asked
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(compare(os.Args[2:]))
+	}
+
 	// retrieve options
 	options, err := ParseOpts()
 	if err != nil {
@@ -37,8 +46,55 @@ func main() {
 		os.Exit(1)
 	}
 
-	// setup dbquerygroups
+	// open the results output file, if any
+	var output ResultWriter
+	if options.Output != "" {
+		output, err = NewResultWriter(options.Output, options.Format)
+		if err != nil {
+			fmt.Printf("output file error: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	// the default connection settings for all databases
+	defaultSettings, err := options.Settings()
+	if err != nil {
+		fmt.Printf("connection options error: %s", err)
+		os.Exit(1)
+	}
+
+	// setup dbquerygroups, recording query timings in metrics
 	queryGroups := []*DBQueryGroup{}
+	metrics := NewMetrics()
+	errorLimits := map[string]*ErrorLimits{}
+
+	// count in-flight queries for the metrics exporter and dashboard
+	var inFlight *InFlight
+	if options.Listen != "" || options.TUI {
+		inFlight = NewInFlight()
+	}
+
+	// serve prometheus metrics, if required
+	var exporter *Exporter
+	if options.Listen != "" {
+		exporter = NewExporter(inFlight)
+		listener, err := net.Listen("tcp", options.Listen)
+		if err != nil {
+			fmt.Printf("metrics listener error: %s", err)
+			os.Exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exporter)
+		go func() {
+			log.Println(http.Serve(listener, mux))
+		}()
+	}
+
+	// sample the server activity of each group's databases, if required
+	var monitor *Monitor
+	if options.Monitor > 0 {
+		monitor = NewMonitor()
+	}
 
 	for dbGroupName, dbGroup := range config {
 
@@ -49,22 +105,81 @@ func main() {
 			options.DontCycle,
 		)
 
+		// queries in the group share a rate scheduler, which may be
+		// adjusted by a load profile
+		scheduler := NewScheduler(dbGroup.Rate)
+		if dbGroup.Profile != nil {
+			dbqg.SetProfile(dbGroup.Profile, dbGroup.Rate, scheduler)
+		}
+
+		// make the group's queries, which share parameter generators
+		queries, err := NewQueries(dbGroup.Queries, dbGroup.Timeouts)
+		if err != nil {
+			fmt.Printf("query error in group %s: %s", dbGroupName, err)
+			os.Exit(1)
+		}
+		transactions, err := NewTransactions(dbGroup.Transactions, dbGroup.Timeouts)
+		if err != nil {
+			fmt.Printf("transaction error in group %s: %s", dbGroupName, err)
+			os.Exit(1)
+		}
+
+		// a weighted mix picks one query by weight for each iteration
+		var mix *Mix
+		if dbGroup.Mix == "weighted" {
+			mix = NewMix(dbGroup.weights())
+		}
+
+		// a pool smaller than the group's peak concurrency models
+		// contention for connections, which caps the load applied
+		if p := dbGroup.Pool; p != nil && p.MaxConns > 0 && int(p.MaxConns) < dbGroup.peakConcurrency() {
+			log.Printf(
+				"group %s pool max_conns %d is below its peak concurrency %d, workers will wait for connections",
+				dbGroupName, p.MaxConns, dbGroup.peakConcurrency(),
+			)
+		}
+
 		// setup each database
-		for _, db := range dbGroup.Databases {
+		for _, db := range dbGroup.databases() {
 			dbq := DBQuery{
-				DBName:     db,
-				Iterations: dbGroup.Iterations,
-				Queries:    dbGroup.Queries,
+				DBName:       db.Label(),
+				Iterations:   dbGroup.Iterations,
+				Queries:      queries,
+				Transactions: transactions,
+				InFlight:     inFlight,
+				Scheduler:    scheduler,
+				Mix:          mix,
+				Session:      dbGroup.SessionConfig,
+				Protocol:     dbGroup.Protocol,
+			}
+			// make connection string from the database's target, if
+			// any, with the command line options as defaults
+			settings, err := dbGroup.Targets[db.Target].settings(defaultSettings)
+			if err != nil {
+				fmt.Printf("connection settings error for %s: %s", db.Label(), err)
+				os.Exit(1)
+			}
+			if err := dbq.setDBURL(settings, db.Name); err != nil {
+				fmt.Printf("client certificate error for %s: %s", db.Label(), err)
+				os.Exit(1)
+			}
+			if monitor != nil {
+				monitor.Add(dbGroupName, dbq)
+			}
+			// make a connection pool shared by the group's workers
+			if dbGroup.Pool != nil {
+				if err := dbq.setPool(context.Background(), dbGroup.Pool, dbGroup.peakConcurrency()); err != nil {
+					fmt.Printf("pool error for %s: %s", db.Label(), err)
+					os.Exit(1)
+				}
+				defer dbq.closePool()
 			}
-			// make connection url
-			dbq.setDBURL(
-				options.User, options.Pass, options.Host, strconv.Itoa(options.Port), db,
-			)
 			// cannot send slice of interface; add one by one
 			dbqg.AddQuerier(dbq)
 		}
 
 		queryGroups = append(queryGroups, dbqg)
+		errorLimits[dbGroupName] = NewErrorLimits(dbGroup.MaxErrorRate, dbGroup.AbortOn)
 	}
 
 	// create context to allow closing of all goroutines
@@ -77,53 +192,229 @@ func main() {
 	}
 	defer cancel()
 
+	// show a live dashboard in place of logging query results, with any
+	// log lines shown below the dashboard
+	var dashboard *Dashboard
+	dashboardStop, dashboardDone := make(chan struct{}), make(chan struct{})
+	if options.TUI {
+		dashboard = NewDashboard(inFlight, time.Duration(options.Duration)*time.Second)
+		log.SetOutput(dashboard)
+		go func() {
+			dashboard.Run(dashboardStop, os.Stdout)
+			close(dashboardDone)
+		}()
+	}
+
+	// cancel the run on an interrupt or terminate signal, reporting
+	// what has completed, and exit immediately on a second signal
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		log.Printf("received %s, cancelling queries (repeat to exit immediately)", s)
+		cancel()
+		s = <-signals
+		log.Printf("received %s, exiting", s)
+		os.Exit(1)
+	}()
+
+	// run the server monitor alongside the query groups
+	monitorStop, monitorDone := make(chan struct{}), make(chan struct{})
+	if monitor != nil {
+		go func() {
+			monitor.Run(monitorStop, time.Duration(options.Monitor)*time.Second)
+			close(monitorDone)
+		}()
+	}
+
+	// report the throughput, errors and latency of each group at
+	// intervals, with any server statistics, logging each report and
+	// writing it to the output file
+	var intervals *IntervalReporter
+	intervalsStop, intervalsDone := make(chan struct{}), make(chan struct{})
+	reportIntervals := func(now time.Time) {
+		var server map[string]*ServerStats
+		if monitor != nil {
+			server = monitor.Report()
+		}
+		for _, r := range intervals.Report(now) {
+			r.Server = server[r.Group]
+			log.Println(r)
+			if r.Server != nil {
+				log.Println(r.ServerString())
+			}
+			if output != nil {
+				if err := output.WriteInterval(r); err != nil {
+					log.Printf("output write error: %s", err)
+				}
+			}
+		}
+	}
+	if options.ReportInterval > 0 {
+		intervals = NewIntervalReporter()
+		go func() {
+			defer close(intervalsDone)
+			ticker := time.NewTicker(time.Duration(options.ReportInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-intervalsStop:
+					return
+				case now := <-ticker.C:
+					reportIntervals(now)
+				}
+			}
+		}()
+	}
+
 	// process each queryGroup, using a context to allow cancellation of
-	// associated goroutines and database queries
-	doneCount := 0
+	// associated goroutines and database queries, and handle its errors
+	// and results until its channels are closed on completion
+	var groups sync.WaitGroup
 	t1 := time.Now()
 	for _, qg := range queryGroups {
+		groups.Add(1)
 		go func(qgHere *DBQueryGroup) {
+			defer groups.Done()
 			go qgHere.Process(ctx)
 
-			for {
+			// end the run if the group's error limits are exceeded
+			limits := errorLimits[qgHere.Name]
+			checkLimits := func(err error) {
+				if err != nil && ctx.Err() == nil {
+					log.Printf("ending run, query group %s limit exceeded: %s", qgHere.Name, err)
+					cancel()
+				}
+			}
+
+			errorChan, resultChan := qgHere.errorChan, qgHere.resultChan
+			for errorChan != nil || resultChan != nil {
 				select {
-				case e := <-qgHere.errorChan:
+				case e, ok := <-errorChan:
+					if !ok {
+						errorChan = nil
+						continue
+					}
 					log.Println(e)
+					metrics.RecordError(qgHere.Name)
+					if exporter != nil {
+						exporter.RecordError(qgHere.Name)
+					}
+					if dashboard != nil {
+						dashboard.RecordError(qgHere.Name)
+					}
+					if intervals != nil {
+						intervals.RecordError(qgHere.Name)
+					}
+					checkLimits(limits.CheckError())
 					if options.ErrExit {
 						log.Println("exiting on first error")
 						cancel()
 					}
-				case r := <-qgHere.resultChan:
-					log.Println(r)
-				case <-qgHere.done:
-					log.Printf("query group %s done", qgHere.Name)
-					doneCount++
-					if doneCount == len(queryGroups) {
+				case r, ok := <-resultChan:
+					if !ok {
+						resultChan = nil
+						continue
+					}
+					metrics.Record(r)
+					if exporter != nil {
+						exporter.Record(r)
+					}
+					if dashboard != nil {
+						dashboard.Record(r)
+					}
+					if intervals != nil {
+						intervals.Record(r)
+					}
+					if output != nil {
+						if err := output.Write(r); err != nil {
+							log.Printf("output write error: %s", err)
+						}
+					}
+					if !(options.Quiet || options.TUI) || r.Err != nil {
+						log.Println(r)
+					}
+					if r.Err != nil && !r.Timeout && options.ErrExit {
+						log.Println("exiting on first error")
 						cancel()
 					}
-					// ctx.Done() is caught by the general querygroup
-					// select below
+					checkLimits(limits.Check(r))
 				}
 			}
+			log.Printf("query group %s done: %s", qgHere.Name, qgHere.Wait())
 
 		}(qg)
 	}
 
-LOOP:
-	for {
-		select {
-		// catch context cancellations due to cancel or timeout events
-		// across querygroups
-		case <-ctx.Done():
-			if err := ctx.Err(); err != nil {
-				log.Println(err)
-			}
-			cancel()
-			break LOOP
-		}
+	// wait for the query groups to complete, either by processing each
+	// database once with dontcycle, or by cancellation due to the
+	// duration, an error or a signal, after which interrupted queries are
+	// cancelled and the results of those that completed are recorded
+	groups.Wait()
+	if err := ctx.Err(); err != nil {
+		log.Println(err)
+	}
+	cancel()
+
+	// take a final server sample
+	if monitor != nil {
+		close(monitorStop)
+		<-monitorDone
+	}
+
+	// report the final, partial, interval
+	if intervals != nil {
+		close(intervalsStop)
+		<-intervalsDone
+		reportIntervals(time.Now())
+	}
+
+	// draw the dashboard a final time, restoring the log output
+	if dashboard != nil {
+		close(dashboardStop)
+		<-dashboardDone
+		log.SetOutput(os.Stderr)
 	}
 
 	// finish up
 	t2 := time.Now()
 	log.Printf("Completed in %s\n", t2.Sub(t1))
+	if output != nil {
+		if err := output.Close(); err != nil {
+			log.Printf("output close error: %s", err)
+		}
+	}
+	metrics.Summary(os.Stdout)
+	if monitor != nil {
+		monitor.Summary(os.Stdout)
+	}
+}
+
+// compare compares the results files of a baseline and a current run,
+// returning the exit status: 0 if there is no regression, 1 on a
+// regression and 2 on an error
+func compare(args []string) int {
+
+	options, err := ParseCompareOpts(args)
+	if err != nil {
+		return 2
+	}
+
+	runs := []*Run{}
+	for _, path := range []string{options.Args.Baseline, options.Args.Current} {
+		results, err := ReadResults(path, options.Format)
+		if err != nil {
+			fmt.Printf("results file error: %s\n", err)
+			return 2
+		}
+		runs = append(runs, NewRun(results))
+	}
+
+	comparisons := Compare(runs[0], runs[1], options.Threshold)
+	WriteComparison(os.Stdout, comparisons)
+	if Regressed(comparisons) {
+		fmt.Printf("regression beyond the %g%% threshold\n", options.Threshold)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// histogram bucket layout: values below subBucketCount microseconds are
+// recorded exactly, larger values are recorded in log-linear buckets of
+// subBucketHalf entries each, giving a worst case precision of about
+// 0.1%, in the manner of an HDR histogram
+const (
+	subBucketBits  = 11
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount >> 1
+)
+
+// percentiles are the percentiles reported in summaries
+var percentiles = []float64{50, 90, 95, 99, 99.9}
+
+// Histogram records durations at microsecond resolution
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// bucketIndex returns the histogram bucket for a value in microseconds
+func bucketIndex(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalf + int(v>>uint(shift)) - subBucketHalf
+}
+
+// bucketValue returns the highest value in microseconds recorded in
+// bucket i
+func bucketValue(i int) uint64 {
+	if i < subBucketCount {
+		return uint64(i)
+	}
+	shift := uint((i-subBucketCount)/subBucketHalf + 1)
+	sub := uint64((i-subBucketCount)%subBucketHalf + subBucketHalf)
+	return ((sub + 1) << shift) - 1
+}
+
+// Record adds a duration to the histogram
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bucketIndex(uint64(d / time.Microsecond))
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Merge adds the durations recorded in o to the histogram
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		counts := make([]int64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// Count returns the number of recorded durations
+func (h *Histogram) Count() int64 { return h.count }
+
+// Min returns the smallest recorded duration
+func (h *Histogram) Min() time.Duration { return h.min }
+
+// Max returns the largest recorded duration
+func (h *Histogram) Max() time.Duration { return h.max }
+
+// Mean returns the mean of the recorded durations
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile returns the duration at or below which p percent of the
+// recorded durations fall
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(p / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			v := time.Duration(bucketValue(i)) * time.Microsecond
+			if v > h.max {
+				v = h.max
+			}
+			if v < h.min {
+				v = h.min
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// Stats aggregates the timings and error and timeout counts for a set
+// of queries
+type Stats struct {
+	Histogram
+	Errors   int64
+	Timeouts int64 // not included in Errors
+}
+
+// record records a query timing, error or timeout
+func (s *Stats) record(d time.Duration, err error, timeout bool) {
+	switch {
+	case timeout:
+		s.Timeouts++
+	case err != nil:
+		s.Errors++
+	default:
+		s.Record(d)
+	}
+}
+
+// metricKey identifies a group and a database or query within it
+type metricKey struct {
+	group string
+	name  string
+}
+
+// Metrics aggregates query timings per query group, per database and
+// per query name or text, and the scheduling lag of rate limited query
+// groups. It is safe for concurrent use.
+type Metrics struct {
+	mu        sync.Mutex
+	groups    map[string]*Stats
+	databases map[metricKey]*Stats
+	queries   map[metricKey]*Stats
+	lags      map[string]*Histogram
+	tls       map[metricKey]map[string]int64 // results by tls version
+	classes   map[string]map[string]int64    // group errors by class
+	protocols map[string]string              // group protocol modes
+}
+
+// NewMetrics returns a new Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		groups:    map[string]*Stats{},
+		databases: map[metricKey]*Stats{},
+		queries:   map[metricKey]*Stats{},
+		lags:      map[string]*Histogram{},
+		tls:       map[metricKey]map[string]int64{},
+		classes:   map[string]map[string]int64{},
+		protocols: map[string]string{},
+	}
+}
+
+// Record records the duration, error or timeout of a query result. A result
+// with an empty query records a database level error, such as a
+// connection failure, which is not attributed to any query. Statements
+// in transactions are only recorded per statement, the group and
+// database totals including their transaction instead.
+func (m *Metrics) Record(r QueryResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := func(s *Stats) *Stats {
+		if s == nil {
+			s = &Stats{}
+		}
+		s.record(r.Duration, r.Err, r.Timeout)
+		return s
+	}
+	if !r.IsStatement() {
+		m.groups[r.Group] = stats(m.groups[r.Group])
+		dbKey := metricKey{r.Group, r.Database}
+		m.databases[dbKey] = stats(m.databases[dbKey])
+		if class := r.ErrorClass(); class != "" {
+			m.recordClass(r.Group, class)
+		}
+		if r.Protocol != "" {
+			m.protocols[r.Group] = r.Protocol
+		}
+	}
+	if r.Query != "" {
+		queryKey := metricKey{r.Group, r.QueryLabel()}
+		m.queries[queryKey] = stats(m.queries[queryKey])
+	}
+	if !r.Scheduled.IsZero() {
+		if m.lags[r.Group] == nil {
+			m.lags[r.Group] = &Histogram{}
+		}
+		m.lags[r.Group].Record(r.Lag())
+	}
+	if r.Query != "" && !r.IsStatement() {
+		dbKey := metricKey{r.Group, r.Database}
+		if m.tls[dbKey] == nil {
+			m.tls[dbKey] = map[string]int64{}
+		}
+		version := r.TLS
+		if version == "" {
+			version = "none"
+		}
+		m.tls[dbKey][version]++
+	}
+}
+
+// recordClass counts an error of a class for a group
+func (m *Metrics) recordClass(group, class string) {
+	if m.classes[group] == nil {
+		m.classes[group] = map[string]int64{}
+	}
+	m.classes[group][class]++
+}
+
+// RecordError records a query group error which is not associated with
+// a query, classed as other
+func (m *Metrics) RecordError(group string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recordClass(group, classOther)
+}
+
+// sortedKeys returns the keys of a stats map in group, name order
+func sortedKeys(s map[metricKey]*Stats) []metricKey {
+	keys := []metricKey{}
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sortMetricKeys(keys)
+	return keys
+}
+
+// sortMetricKeys sorts keys in group, name order
+func sortMetricKeys(keys []metricKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].name < keys[j].name
+	})
+}
+
+// shortQuery flattens the whitespace in a query and truncates it for
+// display
+func shortQuery(q string) string {
+	q = strings.Join(strings.Fields(q), " ")
+	if len(q) > 40 {
+		q = q[:37] + "..."
+	}
+	return q
+}
+
+// millis formats a duration as fractional milliseconds
+func millis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+// Summary writes a summary table of the recorded metrics to w, with
+// timings reported in milliseconds
+func (m *Metrics) Summary(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "group\tdatabase/query\tcount\terrors\ttimeouts\tmin\tmean\tmax\t"
+	for _, p := range percentiles {
+		header += fmt.Sprintf("p%g\t", p)
+	}
+	fmt.Fprintln(tw, header)
+
+	row := func(group, name string, s *Stats) {
+		line := fmt.Sprintf(
+			"%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t",
+			group, name, s.Count(), s.Errors, s.Timeouts,
+			millis(s.Min()), millis(s.Mean()), millis(s.Max()),
+		)
+		for _, p := range percentiles {
+			line += millis(s.Percentile(p)) + "\t"
+		}
+		fmt.Fprintln(tw, line)
+	}
+
+	groups := []string{}
+	for g := range m.groups {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	dbKeys := sortedKeys(m.databases)
+	queryKeys := sortedKeys(m.queries)
+
+	for _, g := range groups {
+		row(g, "(all)", m.groups[g])
+		for _, k := range dbKeys {
+			if k.group == g {
+				row(g, k.name, m.databases[k])
+			}
+		}
+		for _, k := range queryKeys {
+			if k.group == g {
+				row(g, shortQuery(k.name), m.queries[k])
+			}
+		}
+	}
+	tw.Flush()
+
+	// report the delay between scheduled and actual query starts
+	for _, g := range groups {
+		if h, ok := m.lags[g]; ok {
+			fmt.Fprintf(
+				w, "%s scheduling lag: p50 %s p99 %s max %s\n",
+				g, millis(h.Percentile(50)), millis(h.Percentile(99)), millis(h.Max()),
+			)
+		}
+	}
+
+	// report the errors of each group by class
+	classGroups := []string{}
+	for g := range m.classes {
+		classGroups = append(classGroups, g)
+	}
+	sort.Strings(classGroups)
+	for _, g := range classGroups {
+		counts := []string{}
+		for _, c := range errorClasses {
+			if n := m.classes[g][c]; n > 0 {
+				counts = append(counts, fmt.Sprintf("%s (%d)", c, n))
+			}
+		}
+		fmt.Fprintf(w, "%s errors: %s\n", g, strings.Join(counts, ", "))
+	}
+
+	// report the protocol mode of groups with one set, for comparison
+	// with other groups running the same queries
+	for _, g := range groups {
+		if p, ok := m.protocols[g]; ok {
+			fmt.Fprintf(w, "%s protocol: %s\n", g, p)
+		}
+	}
+
+	// report the tls versions negotiated by each database's connections,
+	// with result counts if these differ
+	tlsKeys := []metricKey{}
+	for k := range m.tls {
+		tlsKeys = append(tlsKeys, k)
+	}
+	sortMetricKeys(tlsKeys)
+	for _, k := range tlsKeys {
+		versions := []string{}
+		for v := range m.tls[k] {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		if len(versions) > 1 {
+			for i, v := range versions {
+				versions[i] = fmt.Sprintf("%s (%d)", v, m.tls[k][v])
+			}
+		}
+		fmt.Fprintf(w, "%s %s tls: %s\n", k.group, k.name, strings.Join(versions, ", "))
+	}
+}
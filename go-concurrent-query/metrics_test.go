@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHistogramBuckets checks that bucket values bound the values
+// recorded in them
+func TestHistogramBuckets(t *testing.T) {
+	for _, v := range []uint64{0, 1, 2047, 2048, 2049, 4095, 4096, 123456, 987654321} {
+		i := bucketIndex(v)
+		if bucketValue(i) < v {
+			t.Errorf("bucket %d value %d less than %d", i, bucketValue(i), v)
+		}
+		if i > 0 && bucketValue(i-1) >= v {
+			t.Errorf("previous bucket %d value %d not less than %d", i-1, bucketValue(i-1), v)
+		}
+	}
+}
+
+// TestHistogramPercentiles checks percentiles are within the expected
+// precision
+func TestHistogramPercentiles(t *testing.T) {
+	h := Histogram{}
+	for i := 1; i <= 10000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	if h.Count() != 10000 {
+		t.Errorf("count %d should be 10000", h.Count())
+	}
+	if h.Min() != time.Millisecond {
+		t.Errorf("min %s should be 1ms", h.Min())
+	}
+	if h.Max() != 10*time.Second {
+		t.Errorf("max %s should be 10s", h.Max())
+	}
+	if h.Mean() != 5000500*time.Microsecond {
+		t.Errorf("mean %s should be 5.0005s", h.Mean())
+	}
+
+	for _, tt := range []struct {
+		p      float64
+		expect time.Duration
+	}{
+		{50, 5 * time.Second},
+		{90, 9 * time.Second},
+		{99, 9900 * time.Millisecond},
+		{99.9, 9990 * time.Millisecond},
+		{100, 10 * time.Second},
+	} {
+		got := h.Percentile(tt.p)
+		diff := got - tt.expect
+		if diff < 0 {
+			diff = -diff
+		}
+		if float64(diff) > float64(tt.expect)*0.001 {
+			t.Errorf("p%g %s not within 0.1%% of %s", tt.p, got, tt.expect)
+		}
+	}
+}
+
+// TestHistogramMerge checks merging histograms matches recording all
+// their durations in one
+func TestHistogramMerge(t *testing.T) {
+	all, a, b := Histogram{}, Histogram{}, Histogram{}
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i) * time.Millisecond
+		all.Record(d)
+		if i%3 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+	}
+	merged := Histogram{}
+	merged.Merge(&Histogram{})
+	merged.Merge(&a)
+	merged.Merge(&b)
+
+	if merged.Count() != all.Count() || merged.Mean() != all.Mean() {
+		t.Errorf("count %d mean %s should be %d %s", merged.Count(), merged.Mean(), all.Count(), all.Mean())
+	}
+	if merged.Min() != all.Min() || merged.Max() != all.Max() {
+		t.Errorf("min %s max %s should be %s %s", merged.Min(), merged.Max(), all.Min(), all.Max())
+	}
+	for _, p := range []float64{50, 95, 99} {
+		if merged.Percentile(p) != all.Percentile(p) {
+			t.Errorf("p%g %s should be %s", p, merged.Percentile(p), all.Percentile(p))
+		}
+	}
+}
+
+// TestMetricsSummary checks aggregation by group, database and query
+func TestMetricsSummary(t *testing.T) {
+	m := NewMetrics()
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: 2 * time.Millisecond})
+	m.Record(QueryResult{Group: "g1", Database: "db2", Query: "select 1", Duration: 4 * time.Millisecond})
+	m.Record(QueryResult{Group: "g1", Database: "db2", Query: "select 2", Err: errors.New("failed"), TLS: "TLSv1.3"})
+	m.Record(QueryResult{Group: "g1", Database: "db3", QueryIndex: -1, Err: errors.New("connection failed")})
+
+	if c := m.groups["g1"].Count(); c != 2 {
+		t.Errorf("group count %d should be 2", c)
+	}
+	if e := m.groups["g1"].Errors; e != 2 {
+		t.Errorf("group errors %d should be 2", e)
+	}
+	if e := m.databases[metricKey{"g1", "db3"}].Errors; e != 1 {
+		t.Errorf("db3 errors %d should be 1", e)
+	}
+	if c := m.queries[metricKey{"g1", "select 1"}].Count(); c != 2 {
+		t.Errorf("query count %d should be 2", c)
+	}
+	if len(m.queries) != 2 {
+		t.Errorf("expected 2 queries, got %d", len(m.queries))
+	}
+
+	var b bytes.Buffer
+	m.Summary(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("expected 10 summary lines, got %d", len(lines))
+	}
+	if lines[7] != "g1 errors: connection (1), other (1)" {
+		t.Errorf("unexpected error class summary line %q", lines[7])
+	}
+	if lines[8] != "g1 db1 tls: none" || lines[9] != "g1 db2 tls: TLSv1.3 (1), none (1)" {
+		t.Errorf("unexpected tls summary lines %q", lines[8:])
+	}
+	if !strings.Contains(lines[0], "p99.9") {
+		t.Errorf("header should include p99.9: %s", lines[0])
+	}
+	t.Log("\n" + b.String())
+}
+
+// TestMetricsTimeouts checks that timeouts are counted separately from
+// errors and are not timed
+func TestMetricsTimeouts(t *testing.T) {
+	m := NewMetrics()
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: time.Millisecond})
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: time.Second, Err: errors.New("timeout"), Timeout: true})
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Err: errors.New("failed")})
+
+	s := m.queries[metricKey{"g1", "select 1"}]
+	if s.Count() != 1 || s.Errors != 1 || s.Timeouts != 1 {
+		t.Errorf("count %d errors %d timeouts %d should each be 1", s.Count(), s.Errors, s.Timeouts)
+	}
+	if s.Max() != time.Millisecond {
+		t.Errorf("max %s should be 1ms", s.Max())
+	}
+
+	var b bytes.Buffer
+	m.Summary(&b)
+	if !strings.Contains(strings.SplitN(b.String(), "\n", 2)[0], "timeouts") {
+		t.Errorf("header should include timeouts:\n%s", b.String())
+	}
+}
+
+// TestMetricsProtocol checks the protocol mode of groups is reported
+func TestMetricsProtocol(t *testing.T) {
+	m := NewMetrics()
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "select 1", Duration: time.Millisecond, Protocol: "simple"})
+	m.Record(QueryResult{Group: "g2", Database: "db1", Query: "select 1", Duration: time.Millisecond})
+
+	var b bytes.Buffer
+	m.Summary(&b)
+	if !strings.Contains(b.String(), "\ng1 protocol: simple\n") || strings.Contains(b.String(), "g2 protocol") {
+		t.Errorf("unexpected protocol summary:\n%s", b.String())
+	}
+}
+
+// TestMetricsTransactions checks that transaction statements are not
+// counted in group and database totals
+func TestMetricsTransactions(t *testing.T) {
+	m := NewMetrics()
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "update x", Transaction: "t1", Statement: 1, Duration: time.Millisecond})
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "update y", Transaction: "t1", Statement: 2, Duration: time.Millisecond})
+	m.Record(QueryResult{Group: "g1", Database: "db1", Query: "update x; update y", Transaction: "t1", Duration: 3 * time.Millisecond})
+
+	if c := m.groups["g1"].Count(); c != 1 {
+		t.Errorf("group count %d should be 1", c)
+	}
+	if c := m.databases[metricKey{"g1", "db1"}].Count(); c != 1 {
+		t.Errorf("database count %d should be 1", c)
+	}
+	if len(m.queries) != 3 {
+		t.Errorf("expected 3 query stats, got %d", len(m.queries))
+	}
+}
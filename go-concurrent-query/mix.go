@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mix picks queries at random according to their weights, so that a
+// query group can reproduce the ratio of queries in a workload. It is
+// safe for concurrent use.
+type Mix struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	cumulative []float64
+}
+
+// NewMix returns a Mix for the query and transaction weights, where
+// unset weights count as 1
+func NewMix(weights []float64) *Mix {
+	m := &Mix{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	total := 0.0
+	for _, w := range weights {
+		if w == 0 {
+			w = 1
+		}
+		total += w
+		m.cumulative = append(m.cumulative, total)
+	}
+	return m
+}
+
+// order returns the indexes of the queries or transactions to run for
+// an iteration of n: all of them in order, or a single one picked by
+// weight if m is not nil
+func (m *Mix) order(n int) []int {
+	if m == nil {
+		order := make([]int, n)
+		for i := range order {
+			order[i] = i
+		}
+		return order
+	}
+	m.mu.Lock()
+	r := m.rand.Float64() * m.cumulative[len(m.cumulative)-1]
+	m.mu.Unlock()
+	i := sort.Search(len(m.cumulative), func(i int) bool { return m.cumulative[i] > r })
+	return []int{i}
+}
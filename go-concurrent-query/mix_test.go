@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestMixWeights checks that queries are picked in proportion to their
+// weights
+func TestMixWeights(t *testing.T) {
+	m := NewMix([]float64{70, 25, 5})
+
+	counts := make([]int, 3)
+	n := 100000
+	for i := 0; i < n; i++ {
+		order := m.order(3)
+		if len(order) != 1 {
+			t.Fatalf("weighted order should pick 1 query, got %d", len(order))
+		}
+		counts[order[0]]++
+	}
+	for i, expect := range []float64{0.70, 0.25, 0.05} {
+		got := float64(counts[i]) / float64(n)
+		if math.Abs(got-expect) > 0.01 {
+			t.Errorf("query %d picked %0.3f of the time, expected %0.2f", i, got, expect)
+		}
+	}
+}
+
+// TestMixSequential checks that a nil mix runs all queries in order
+func TestMixSequential(t *testing.T) {
+	var m *Mix
+	order := m.order(3)
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("sequential order %v should be [0 1 2]", order)
+	}
+}
+
+// TestMixZeroWeights checks that unset weights count as 1
+func TestMixZeroWeights(t *testing.T) {
+	m := NewMix([]float64{0, 3})
+	if m.cumulative[0] != 1 || m.cumulative[1] != 4 {
+		t.Errorf("unexpected cumulative weights %v", m.cumulative)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// activitySQL counts the client sessions on the database, other than
+// the monitor's own, by state and wait event
+const activitySQL = `
+select coalesce(state, ''), coalesce(wait_event_type || ':' || wait_event, ''), count(*)
+from pg_stat_activity
+where datname = current_database() and pid <> pg_backend_pid() and backend_type = 'client backend'
+group by 1, 2`
+
+// databaseSQL reads the cumulative statistics of the database and counts
+// the locks awaited by its sessions
+const databaseSQL = `
+select xact_commit, xact_rollback, blks_hit, blks_read, deadlocks, temp_bytes,
+	(select count(*) from pg_locks where not granted
+		and pid in (select pid from pg_stat_activity where datname = current_database()))
+from pg_stat_database
+where datname = current_database()`
+
+// monitorWaits is the number of wait events reported for a group, in
+// order of the mean number of sessions waiting
+var monitorWaits = 5
+
+// DatabaseStats holds statistics from pg_stat_database
+type DatabaseStats struct {
+	Commits   int64
+	Rollbacks int64
+	BlksHit   int64
+	BlksRead  int64
+	Deadlocks int64
+	TempBytes int64
+}
+
+// add adds o to the statistics
+func (s *DatabaseStats) add(o DatabaseStats) {
+	s.Commits += o.Commits
+	s.Rollbacks += o.Rollbacks
+	s.BlksHit += o.BlksHit
+	s.BlksRead += o.BlksRead
+	s.Deadlocks += o.Deadlocks
+	s.TempBytes += o.TempBytes
+}
+
+// sub returns the change in the statistics since o
+func (s DatabaseStats) sub(o DatabaseStats) DatabaseStats {
+	return DatabaseStats{
+		Commits:   s.Commits - o.Commits,
+		Rollbacks: s.Rollbacks - o.Rollbacks,
+		BlksHit:   s.BlksHit - o.BlksHit,
+		BlksRead:  s.BlksRead - o.BlksRead,
+		Deadlocks: s.Deadlocks - o.Deadlocks,
+		TempBytes: s.TempBytes - o.TempBytes,
+	}
+}
+
+// serverSample is a sample of the sessions and statistics of one or
+// more databases
+type serverSample struct {
+	sessions  map[string]int64 // by state
+	waits     map[string]int64 // active sessions by wait event
+	lockWaits int64
+	database  DatabaseStats // change since the previous sample
+}
+
+// newServerSample returns an empty serverSample
+func newServerSample() serverSample {
+	return serverSample{sessions: map[string]int64{}, waits: map[string]int64{}}
+}
+
+// add adds the sessions and statistics of o to the sample
+func (s *serverSample) add(o serverSample) {
+	for k, n := range o.sessions {
+		s.sessions[k] += n
+	}
+	for k, n := range o.waits {
+		s.waits[k] += n
+	}
+	s.lockWaits += o.lockWaits
+	s.database.add(o.database)
+}
+
+// ServerStats aggregates the server samples of a query group's
+// databases over a period. Session counts are summed over the samples
+// to report their mean, while the database statistics are the change
+// over the period.
+type ServerStats struct {
+	Samples   int64
+	Sessions  map[string]int64 // by state
+	Waits     map[string]int64 // active sessions by wait event
+	LockWaits int64
+	Database  DatabaseStats
+}
+
+// newServerStats returns an empty ServerStats
+func newServerStats() *ServerStats {
+	return &ServerStats{Sessions: map[string]int64{}, Waits: map[string]int64{}}
+}
+
+// add adds a sample, taken from all the group's databases
+func (s *ServerStats) add(sample serverSample) {
+	s.Samples++
+	for k, n := range sample.sessions {
+		s.Sessions[k] += n
+	}
+	for k, n := range sample.waits {
+		s.Waits[k] += n
+	}
+	s.LockWaits += sample.lockWaits
+	s.Database.add(sample.database)
+}
+
+// mean returns the mean of a count summed over the samples
+func (s *ServerStats) mean(n int64) float64 {
+	if s.Samples == 0 {
+		return 0
+	}
+	return float64(n) / float64(s.Samples)
+}
+
+// Waiting returns the mean number of active sessions waiting on an
+// event
+func (s *ServerStats) Waiting() float64 {
+	var n int64
+	for _, w := range s.Waits {
+		n += w
+	}
+	return s.mean(n)
+}
+
+// CacheHit returns the percentage of blocks read found in the buffer
+// cache
+func (s *ServerStats) CacheHit() float64 {
+	blocks := s.Database.BlksHit + s.Database.BlksRead
+	if blocks == 0 {
+		return 0
+	}
+	return 100 * float64(s.Database.BlksHit) / float64(blocks)
+}
+
+// topWaits returns the wait events with the highest mean number of
+// waiting sessions, with their means
+func (s *ServerStats) topWaits() []string {
+	events := []string{}
+	for e := range s.Waits {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if s.Waits[events[i]] != s.Waits[events[j]] {
+			return s.Waits[events[i]] > s.Waits[events[j]]
+		}
+		return events[i] < events[j]
+	})
+	if len(events) > monitorWaits {
+		events = events[:monitorWaits]
+	}
+	for i, e := range events {
+		events[i] = fmt.Sprintf("%s (%.2f)", e, s.mean(s.Waits[e]))
+	}
+	return events
+}
+
+// String reports the mean sessions by state, the lock waits and the
+// change in database statistics, followed by the top wait events
+func (s *ServerStats) String() string {
+	str := fmt.Sprintf(
+		"sessions active %.1f idle %.1f idle in transaction %.1f waiting %.1f, lock waits %.1f, "+
+			"commits %d rollbacks %d, cache hit %.2f%%, deadlocks %d, temp bytes %d",
+		s.mean(s.Sessions["active"]), s.mean(s.Sessions["idle"]), s.mean(s.Sessions["idle in transaction"]),
+		s.Waiting(), s.mean(s.LockWaits),
+		s.Database.Commits, s.Database.Rollbacks, s.CacheHit(), s.Database.Deadlocks, s.Database.TempBytes,
+	)
+	if waits := s.topWaits(); len(waits) > 0 {
+		str += ", waits " + strings.Join(waits, ", ")
+	}
+	return str
+}
+
+// monitorTarget is a database sampled by the monitor for a query group
+type monitorTarget struct {
+	group string
+	db    DBQuery
+	conn  *pgx.Conn
+	last  *DatabaseStats // cumulative statistics of the previous sample
+}
+
+// sample samples the sessions and statistics of the database,
+// connecting if necessary
+func (t *monitorTarget) sample(ctx context.Context) (serverSample, error) {
+	s := newServerSample()
+	if t.conn == nil || t.conn.IsClosed() {
+		config, err := t.db.connConfig()
+		if err != nil {
+			return s, err
+		}
+		if t.conn, err = pgx.ConnectConfig(ctx, config); err != nil {
+			return s, err
+		}
+	}
+
+	rows, err := t.conn.Query(ctx, activitySQL)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state, wait string
+		var n int64
+		if err := rows.Scan(&state, &wait, &n); err != nil {
+			return s, err
+		}
+		s.sessions[state] += n
+		if state == "active" && wait != "" {
+			s.waits[wait] += n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	var db DatabaseStats
+	err = t.conn.QueryRow(ctx, databaseSQL).Scan(
+		&db.Commits, &db.Rollbacks, &db.BlksHit, &db.BlksRead, &db.Deadlocks, &db.TempBytes, &s.lockWaits,
+	)
+	if err != nil {
+		return s, err
+	}
+	if t.last != nil {
+		s.database = db.sub(*t.last)
+	}
+	t.last = &db
+	return s, nil
+}
+
+// close closes the target's connection, if any
+func (t *monitorTarget) close() {
+	if t.conn != nil {
+		t.conn.Close(context.Background())
+		t.conn = nil
+	}
+}
+
+// Monitor periodically samples the server sessions, wait events, lock
+// waits and database statistics of each query group's databases, over
+// its own connections, aggregating them per group for interval reports
+// and for the run. It is safe for concurrent use.
+type Monitor struct {
+	mu        sync.Mutex
+	targets   []*monitorTarget
+	intervals map[string]*ServerStats // since the last report
+	totals    map[string]*ServerStats
+}
+
+// NewMonitor returns a new Monitor
+func NewMonitor() *Monitor {
+	return &Monitor{intervals: map[string]*ServerStats{}, totals: map[string]*ServerStats{}}
+}
+
+// Add adds a database of a query group to be sampled
+func (m *Monitor) Add(group string, db DBQuery) {
+	m.targets = append(m.targets, &monitorTarget{group: group, db: db})
+}
+
+// sample samples each database concurrently, logging any errors, and
+// records the samples of each group
+func (m *Monitor) sample(ctx context.Context) {
+	samples := make([]*serverSample, len(m.targets))
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		wg.Add(1)
+		go func(i int, t *monitorTarget) {
+			defer wg.Done()
+			s, err := t.sample(ctx)
+			if err != nil {
+				log.Printf("monitor error for %s %s: %s", t.group, t.db.DBName, err)
+				t.close()
+				return
+			}
+			samples[i] = &s
+		}(i, t)
+	}
+	wg.Wait()
+
+	groups := map[string]serverSample{}
+	for i, s := range samples {
+		if s == nil {
+			continue
+		}
+		g := m.targets[i].group
+		if _, ok := groups[g]; !ok {
+			groups[g] = newServerSample()
+		}
+		gs := groups[g]
+		gs.add(*s)
+		groups[g] = gs
+	}
+	m.record(groups)
+}
+
+// record records a sample of each group
+func (m *Monitor) record(samples map[string]serverSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for g, s := range samples {
+		if m.intervals[g] == nil {
+			m.intervals[g] = newServerStats()
+		}
+		m.intervals[g].add(s)
+		if m.totals[g] == nil {
+			m.totals[g] = newServerStats()
+		}
+		m.totals[g].add(s)
+	}
+}
+
+// Run samples the databases every interval until stop is closed, when
+// a final sample is taken so that the database statistics cover the
+// whole run, and the monitor's connections are closed
+func (m *Monitor) Run(stop <-chan struct{}, every time.Duration) {
+	defer func() {
+		for _, t := range m.targets {
+			t.close()
+		}
+	}()
+	sample := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), every)
+		defer cancel()
+		m.sample(ctx)
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	sample()
+	for {
+		select {
+		case <-stop:
+			sample()
+			return
+		case <-ticker.C:
+			sample()
+		}
+	}
+}
+
+// Report returns the server statistics of each group since the last
+// report and starts the next interval
+func (m *Monitor) Report() map[string]*ServerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reports := m.intervals
+	m.intervals = map[string]*ServerStats{}
+	return reports
+}
+
+// Summary writes the server statistics of each group over the run to w
+func (m *Monitor) Summary(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := []string{}
+	for g := range m.totals {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s server (%d samples): %s\n", g, m.totals[g].Samples, m.totals[g])
+	}
+}
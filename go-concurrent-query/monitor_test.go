@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testServerSample makes a server sample
+func testServerSample(active, idle, lockWaits int64, waits map[string]int64, db DatabaseStats) serverSample {
+	s := newServerSample()
+	s.sessions["active"] = active
+	s.sessions["idle"] = idle
+	for e, n := range waits {
+		s.waits[e] = n
+	}
+	s.lockWaits = lockWaits
+	s.database = db
+	return s
+}
+
+func TestDatabaseStats(t *testing.T) {
+	first := DatabaseStats{Commits: 100, Rollbacks: 1, BlksHit: 990, BlksRead: 10, TempBytes: 8192}
+	second := DatabaseStats{Commits: 250, Rollbacks: 3, BlksHit: 1980, BlksRead: 20, Deadlocks: 1, TempBytes: 8192}
+	expect := DatabaseStats{Commits: 150, Rollbacks: 2, BlksHit: 990, BlksRead: 10, Deadlocks: 1}
+	if d := second.sub(first); d != expect {
+		t.Errorf("got %+v expected %+v", d, expect)
+	}
+	d := DatabaseStats{}
+	d.add(expect)
+	d.add(expect)
+	if d.Commits != 300 || d.Deadlocks != 2 {
+		t.Errorf("unexpected sum %+v", d)
+	}
+}
+
+// TestServerSample checks the samples of a group's databases are
+// combined
+func TestServerSample(t *testing.T) {
+	s := newServerSample()
+	s.add(testServerSample(2, 1, 1, map[string]int64{"Lock:transactionid": 1}, DatabaseStats{Commits: 10}))
+	s.add(testServerSample(3, 0, 0, map[string]int64{"Lock:transactionid": 1, "IO:DataFileRead": 1}, DatabaseStats{Commits: 5}))
+	if s.sessions["active"] != 5 || s.sessions["idle"] != 1 || s.lockWaits != 1 {
+		t.Errorf("unexpected sessions %v lock waits %d", s.sessions, s.lockWaits)
+	}
+	if s.waits["Lock:transactionid"] != 2 || s.waits["IO:DataFileRead"] != 1 || s.database.Commits != 15 {
+		t.Errorf("unexpected waits %v commits %d", s.waits, s.database.Commits)
+	}
+}
+
+// TestServerStats checks session counts are averaged over the samples
+// and database statistics summed
+func TestServerStats(t *testing.T) {
+	s := newServerStats()
+	s.add(testServerSample(4, 2, 1, map[string]int64{"Lock:transactionid": 2, "LWLock:WALWrite": 1}, DatabaseStats{}))
+	s.add(testServerSample(6, 0, 0, map[string]int64{"Lock:transactionid": 1}, DatabaseStats{Commits: 500, BlksHit: 999, BlksRead: 1}))
+
+	if s.Samples != 2 || s.mean(s.Sessions["active"]) != 5 || s.Waiting() != 2 || s.CacheHit() != 99.9 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	expect := "sessions active 5.0 idle 1.0 idle in transaction 0.0 waiting 2.0, lock waits 0.5, " +
+		"commits 500 rollbacks 0, cache hit 99.90%, deadlocks 0, temp bytes 0, " +
+		"waits Lock:transactionid (1.50), LWLock:WALWrite (0.50)"
+	if s.String() != expect {
+		t.Errorf("got %q expected %q", s, expect)
+	}
+
+	if e := newServerStats(); e.Waiting() != 0 || e.CacheHit() != 0 || strings.Contains(e.String(), ", waits ") {
+		t.Errorf("unexpected empty stats %s", e)
+	}
+}
+
+// TestMonitorReport checks interval reports are reset and the summary
+// covers the run
+func TestMonitorReport(t *testing.T) {
+	m := NewMonitor()
+	m.record(map[string]serverSample{
+		"g1": testServerSample(2, 0, 0, nil, DatabaseStats{}),
+		"g2": testServerSample(1, 0, 0, nil, DatabaseStats{}),
+	})
+	m.record(map[string]serverSample{
+		"g1": testServerSample(4, 0, 0, nil, DatabaseStats{Commits: 20}),
+	})
+
+	reports := m.Report()
+	if len(reports) != 2 || reports["g1"].Samples != 2 || reports["g1"].Database.Commits != 20 {
+		t.Errorf("unexpected reports %+v", reports)
+	}
+	m.record(map[string]serverSample{
+		"g1": testServerSample(6, 0, 0, nil, DatabaseStats{Commits: 10}),
+	})
+	reports = m.Report()
+	if len(reports) != 1 || reports["g1"].Samples != 1 || reports["g1"].Database.Commits != 10 {
+		t.Errorf("unexpected second reports %+v", reports)
+	}
+
+	var b bytes.Buffer
+	m.Summary(&b)
+	got := b.String()
+	t.Log("\n" + got)
+	for _, expect := range []string{
+		"g1 server (3 samples): sessions active 4.0 ",
+		"commits 30 ",
+		"g2 server (1 samples): sessions active 1.0 ",
+	} {
+		if !strings.Contains(got, expect) {
+			t.Errorf("summary does not contain %q", expect)
+		}
+	}
+}
@@ -2,26 +2,34 @@ package main
 
 import (
 	"errors"
-	"net"
 
 	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/pgtools/pgconnect"
 )
 
 // Options show flag options
 type Options struct {
-	User      string `short:"u" long:"user"     description:"database user" required:"true"`
-	Pass      string `short:"p" long:"password" description:"database pass" required:"true"`
+	pgconnect.Options `group:"Connection Options"`
+
 	Config    string `short:"c" long:"config"   description:"database query group yaml file" required:"true"`
-	Port      int    `short:"P" long:"port"     description:"server port" default:"5432"`
-	Host      string `short:"H" long:"host"     description:"server host" default:"127.0.0.1"`
 	Duration  int    `short:"d" long:"duration" description:"limit test duration in seconds" default:"0"`
 	DontCycle bool   `long:"dontcycle" description:"don't cycle databases, process each only once"`
 	ErrExit   bool   `short:"e" long:"errexit"  description:"exit on first query err"`
+	Output    string `short:"o" long:"output"   description:"write query results to file (.jsonl or .csv)"`
+	Format    string `long:"format" description:"output file format, if not set by the file extension" choice:"jsonl" choice:"csv"`
+	Quiet     bool   `short:"q" long:"quiet"    description:"don't log query results"`
+	Listen    string `long:"listen" description:"serve prometheus metrics at /metrics on this address, eg :9100"`
+	TUI       bool   `long:"tui" description:"show a live dashboard instead of logging query results"`
+
+	ReportInterval int `long:"report-interval" description:"report throughput, errors and latency of each group every interval seconds" default:"0"`
+	Monitor        int `long:"monitor" description:"sample server sessions, wait events and database statistics every monitor seconds" default:"0"`
 }
 
 var usage = `
 
-Run queries concurrently on a set of Postgresql databases.`
+Run queries concurrently on a set of Postgresql databases.
+
+To compare the results of two runs see "compare -h".`
 
 // ParseOpts returns the filled options or error
 func ParseOpts() (Options, error) {
@@ -35,17 +43,51 @@ func ParseOpts() (Options, error) {
 		return options, err
 	}
 
-	if options.User == "" || options.Pass == "" {
-		return options, errors.New("Both database user and password must be supplied")
-	}
-
-	if net.ParseIP(options.Host) == nil {
-		return options, errors.New("Invalid IP address for host")
+	if _, err := options.Settings(); err != nil {
+		return options, err
 	}
 
 	if options.Duration < 0 {
 		return options, errors.New("only 0 or positive duration seconds accepted")
 	}
 
+	if options.ReportInterval < 0 {
+		return options, errors.New("only 0 or positive report interval seconds accepted")
+	}
+
+	if options.Monitor < 0 {
+		return options, errors.New("only 0 or positive monitor seconds accepted")
+	}
+
+	return options, nil
+}
+
+// CompareOptions show the flag options of the compare subcommand
+type CompareOptions struct {
+	Threshold float64 `short:"t" long:"threshold" description:"regression threshold, the percentage fall in throughput or rise in latency or error share allowed" default:"10"`
+	Format    string  `long:"format" description:"results file format, if not set by the file extensions" choice:"jsonl" choice:"csv"`
+	Args      struct {
+		Baseline string `positional-arg-name:"baseline" description:"results file of the baseline run, saved with --output"`
+		Current  string `positional-arg-name:"current" description:"results file of the current run, compared with the baseline"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// ParseCompareOpts returns the filled compare subcommand options or
+// error
+func ParseCompareOpts(args []string) (CompareOptions, error) {
+
+	var options CompareOptions
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.Name += " compare"
+	parser.Usage = "[OPTIONS]"
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return options, err
+	}
+
+	if options.Threshold < 0 {
+		return options, errors.New("the regression threshold cannot be negative")
+	}
+
 	return options, nil
 }
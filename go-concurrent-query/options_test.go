@@ -26,18 +26,53 @@ func TestParseOpts(t *testing.T) {
 			errors: false,
 		},
 		{
-			msg:    "no user",
+			msg:    "no user, taken from the environment",
 			args:   `prog -p pass -c config.yaml`,
-			errors: true,
+			errors: false,
 		},
 		{
-			msg:    "no password",
+			msg:    "no password, taken from the environment or .pgpass",
 			args:   `prog -u user -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "connection string",
+			args:   `prog --dsn host=db1,db2 -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "invalid connection string",
+			args:   `prog --dsn host -c config.yaml`,
 			errors: true,
 		},
+		{
+			msg:    "service",
+			args:   `prog --service loadtest -c config.yaml`,
+			errors: false,
+		},
 		{
 			msg:    "invalid host",
-			args:   `prog -u user -p pass -H nonsense -c config.yaml`,
+			args:   `prog -u user -p pass -H db1:5432 -c config.yaml`,
+			errors: true,
+		},
+		{
+			msg:    "host name",
+			args:   `prog -u user -p pass -H db1.example.com -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "socket directory",
+			args:   `prog -u user -H /var/run/postgresql -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "multiple hosts",
+			args:   `prog -u user -H db1,[::1] -P 5432,6432 --target-session-attrs read-write -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "too few ports for hosts",
+			args:   `prog -u user -H db1,db2,db3 -P 5432,6432 -c config.yaml`,
 			errors: true,
 		},
 		{
@@ -45,6 +80,46 @@ func TestParseOpts(t *testing.T) {
 			args:   `prog -u user -p pass -H 8.8.8.8 -c config.yaml`,
 			errors: false,
 		},
+		{
+			msg:    "tls with client certificate",
+			args:   `prog -u user -H db1 --sslmode verify-full --sslrootcert ca.crt --sslcert app.crt --sslkey app.key -c config.yaml`,
+			errors: false,
+		},
+		{
+			msg:    "invalid sslmode",
+			args:   `prog -u user --sslmode always -c config.yaml`,
+			errors: true,
+		},
+		{
+			msg:    "output file with format",
+			args:   `prog -u user -p pass -c config.yaml -o results.out --format csv`,
+			errors: false,
+		},
+		{
+			msg:    "invalid output format",
+			args:   `prog -u user -p pass -c config.yaml -o results.out --format xml`,
+			errors: true,
+		},
+		{
+			msg:    "report interval",
+			args:   `prog -u user -p pass -c config.yaml --report-interval 10`,
+			errors: false,
+		},
+		{
+			msg:    "negative report interval",
+			args:   `prog -u user -p pass -c config.yaml --report-interval=-1`,
+			errors: true,
+		},
+		{
+			msg:    "server monitor",
+			args:   `prog -u user -p pass -c config.yaml --monitor 5 --report-interval 10`,
+			errors: false,
+		},
+		{
+			msg:    "negative monitor interval",
+			args:   `prog -u user -p pass -c config.yaml --monitor=-5`,
+			errors: true,
+		},
 		/*
 			{
 				msg:    "invalid duration",
@@ -71,3 +146,41 @@ func TestParseOpts(t *testing.T) {
 		t.Logf("  result: %+v\n", options)
 	}
 }
+
+func TestParseCompareOpts(t *testing.T) {
+
+	for i, test := range []struct {
+		msg    string
+		args   string
+		errors bool
+	}{
+		{
+			msg:    "baseline and current",
+			args:   `base.jsonl current.jsonl`,
+			errors: false,
+		},
+		{
+			msg:    "threshold and format",
+			args:   `-t 5 --format csv base.out current.out`,
+			errors: false,
+		},
+		{
+			msg:    "no current",
+			args:   `base.jsonl`,
+			errors: true,
+		},
+		{
+			msg:    "negative threshold",
+			args:   `-t -5 base.jsonl current.jsonl`,
+			errors: true,
+		},
+	} {
+		_, err := ParseCompareOpts(strings.Fields(test.args))
+		if test.errors && err == nil {
+			t.Errorf("test %d %s should fail", i, test.msg)
+		}
+		if !test.errors && err != nil {
+			t.Errorf("test %d %s should succeed (err %s)", i, test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResultWriter writes query results, and interval reports, to an output
+// sink. Implementations are safe for concurrent use.
+type ResultWriter interface {
+	Write(r QueryResult) error
+	WriteInterval(r IntervalReport) error
+	Close() error
+}
+
+// csvHeader is the header row of csv output. Interval reports are
+// written with the type, timestamp and group columns and the interval
+// columns which follow the type column.
+var csvHeader = []string{
+	"timestamp", "group", "db", "iteration", "query", "duration", "rows", "sqlstate", "error", "scheduled", "name",
+	"transaction", "statement", "retries", "bytes", "first_row",
+	"tls", "timeout", "error_class", "protocol",
+	"type", "interval", "queries", "errors", "timeouts", "qps", "p50", "p95", "p99",
+	"server_samples", "server_active", "server_idle", "server_idle_in_transaction", "server_waiting",
+	"server_lock_waits", "server_waits", "server_commits", "server_rollbacks", "server_blks_hit",
+	"server_blks_read", "server_deadlocks", "server_temp_bytes",
+}
+
+// intervalType is the type of interval report records, distinguishing
+// them from query results, which have no type
+const intervalType = "interval"
+
+// outputRecord is the serialised form of a QueryResult
+type outputRecord struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Group     string     `json:"group"`
+	DB        string     `json:"db"`
+	Iteration int        `json:"iteration"`
+	Query     string     `json:"query"`
+	Duration  float64    `json:"duration"` // seconds
+	Rows      int64      `json:"rows"`
+	SQLState  string     `json:"sqlstate,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Scheduled *time.Time `json:"scheduled,omitempty"` // rate limited queries only
+	Name      string     `json:"name,omitempty"`
+
+	// transactions and their statements
+	Transaction string `json:"transaction,omitempty"`
+	Statement   int    `json:"statement,omitempty"`
+	Retries     int    `json:"retries,omitempty"`
+
+	// fetch queries
+	Bytes    int64   `json:"bytes,omitempty"`
+	FirstRow float64 `json:"first_row,omitempty"` // seconds
+
+	TLS     string `json:"tls,omitempty"` // negotiated tls version
+	Timeout bool   `json:"timeout,omitempty"`
+
+	ErrorClass string `json:"error_class,omitempty"` // see ErrorClass
+	Protocol   string `json:"protocol,omitempty"`
+
+	Type string `json:"type,omitempty"` // empty for query results
+}
+
+// intervalRecord is the serialised form of an IntervalReport, with
+// durations in seconds
+type intervalRecord struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"` // start of the interval
+	Group     string    `json:"group"`
+	Interval  float64   `json:"interval"`
+	Queries   int64     `json:"queries"` // successful queries
+	Errors    int64     `json:"errors"`
+	Timeouts  int64     `json:"timeouts"`
+	QPS       float64   `json:"qps"`
+	P50       float64   `json:"p50"`
+	P95       float64   `json:"p95"`
+	P99       float64   `json:"p99"`
+
+	Server *serverRecord `json:"server,omitempty"`
+}
+
+// serverRecord is the serialised form of ServerStats, with the mean
+// session counts over the samples
+type serverRecord struct {
+	Samples           int64              `json:"samples"`
+	Active            float64            `json:"active"`
+	Idle              float64            `json:"idle"`
+	IdleInTransaction float64            `json:"idle_in_transaction"`
+	Waiting           float64            `json:"waiting"`
+	LockWaits         float64            `json:"lock_waits"`
+	Waits             map[string]float64 `json:"waits,omitempty"` // by wait event
+	Commits           int64              `json:"commits"`
+	Rollbacks         int64              `json:"rollbacks"`
+	BlksHit           int64              `json:"blks_hit"`
+	BlksRead          int64              `json:"blks_read"`
+	Deadlocks         int64              `json:"deadlocks"`
+	TempBytes         int64              `json:"temp_bytes"`
+}
+
+// newServerRecord converts ServerStats to a serverRecord
+func newServerRecord(s *ServerStats) *serverRecord {
+	o := &serverRecord{
+		Samples:           s.Samples,
+		Active:            s.mean(s.Sessions["active"]),
+		Idle:              s.mean(s.Sessions["idle"]),
+		IdleInTransaction: s.mean(s.Sessions["idle in transaction"]),
+		Waiting:           s.Waiting(),
+		LockWaits:         s.mean(s.LockWaits),
+		Commits:           s.Database.Commits,
+		Rollbacks:         s.Database.Rollbacks,
+		BlksHit:           s.Database.BlksHit,
+		BlksRead:          s.Database.BlksRead,
+		Deadlocks:         s.Database.Deadlocks,
+		TempBytes:         s.Database.TempBytes,
+	}
+	if len(s.Waits) > 0 {
+		o.Waits = map[string]float64{}
+		for e, n := range s.Waits {
+			o.Waits[e] = s.mean(n)
+		}
+	}
+	return o
+}
+
+// fields returns the csv fields of the record by column name, with the
+// wait events as semicolon separated event=mean pairs
+func (o *serverRecord) fields() map[string]string {
+	mean := func(f float64) string { return strconv.FormatFloat(f, 'f', 3, 64) }
+	events := []string{}
+	for e := range o.Waits {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	for i, e := range events {
+		events[i] = e + "=" + mean(o.Waits[e])
+	}
+	return map[string]string{
+		"server_samples":             strconv.FormatInt(o.Samples, 10),
+		"server_active":              mean(o.Active),
+		"server_idle":                mean(o.Idle),
+		"server_idle_in_transaction": mean(o.IdleInTransaction),
+		"server_waiting":             mean(o.Waiting),
+		"server_lock_waits":          mean(o.LockWaits),
+		"server_waits":               strings.Join(events, ";"),
+		"server_commits":             strconv.FormatInt(o.Commits, 10),
+		"server_rollbacks":           strconv.FormatInt(o.Rollbacks, 10),
+		"server_blks_hit":            strconv.FormatInt(o.BlksHit, 10),
+		"server_blks_read":           strconv.FormatInt(o.BlksRead, 10),
+		"server_deadlocks":           strconv.FormatInt(o.Deadlocks, 10),
+		"server_temp_bytes":          strconv.FormatInt(o.TempBytes, 10),
+	}
+}
+
+// newIntervalRecord converts an IntervalReport to an intervalRecord
+func newIntervalRecord(r IntervalReport) intervalRecord {
+	o := intervalRecord{
+		Type:      intervalType,
+		Timestamp: r.Start,
+		Group:     r.Group,
+		Interval:  r.Interval.Seconds(),
+		Queries:   r.Count(),
+		Errors:    r.Errors,
+		Timeouts:  r.Timeouts,
+		QPS:       r.Rate(),
+		P50:       r.Percentile(50).Seconds(),
+		P95:       r.Percentile(95).Seconds(),
+		P99:       r.Percentile(99).Seconds(),
+	}
+	if r.Server != nil {
+		o.Server = newServerRecord(r.Server)
+	}
+	return o
+}
+
+// newOutputRecord converts a QueryResult to an outputRecord
+func newOutputRecord(r QueryResult) outputRecord {
+	o := outputRecord{
+		Timestamp: r.Start,
+		Group:     r.Group,
+		DB:        r.Database,
+		Iteration: r.Iteration,
+		Query:     r.Query,
+		Duration:  r.Duration.Seconds(),
+		Rows:      r.Rows,
+		SQLState:  r.SQLState,
+		Name:      r.QueryName,
+
+		Transaction: r.Transaction,
+		Statement:   r.Statement,
+		Retries:     r.Retries,
+
+		Bytes:    r.Bytes,
+		FirstRow: r.FirstRow.Seconds(),
+
+		TLS:     r.TLS,
+		Timeout: r.Timeout,
+
+		ErrorClass: r.ErrorClass(),
+		Protocol:   r.Protocol,
+	}
+	if r.Err != nil {
+		o.Error = r.Err.Error()
+	}
+	if !r.Scheduled.IsZero() {
+		o.Scheduled = &r.Scheduled
+	}
+	return o
+}
+
+// resultFormat returns the format of a results file, determined from
+// the file extension if format is empty
+func resultFormat(path, format string) (string, error) {
+	if format != "" {
+		return format, nil
+	}
+	switch filepath.Ext(path) {
+	case ".csv":
+		return "csv", nil
+	case ".jsonl", ".json", ".ndjson":
+		return "jsonl", nil
+	}
+	return "", fmt.Errorf("cannot determine output format for %s", path)
+}
+
+// NewResultWriter opens a file for writing results in the given
+// format. If format is empty it is determined from the file extension.
+func NewResultWriter(path, format string) (ResultWriter, error) {
+	format, err := resultFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "jsonl":
+		return &jsonWriter{f: f, enc: json.NewEncoder(f)}, nil
+	case "csv":
+		w := &csvWriter{f: f, w: csv.NewWriter(f)}
+		if err := w.w.Write(csvHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+	f.Close()
+	return nil, fmt.Errorf("unknown output format %s", format)
+}
+
+// jsonWriter writes results in JSON Lines format
+type jsonWriter struct {
+	mu  sync.Mutex
+	f   io.WriteCloser
+	enc *json.Encoder
+}
+
+// Write writes a result as a line of json
+func (j *jsonWriter) Write(r QueryResult) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(newOutputRecord(r))
+}
+
+// WriteInterval writes an interval report as a line of json
+func (j *jsonWriter) WriteInterval(r IntervalReport) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(newIntervalRecord(r))
+}
+
+// Close closes the underlying file
+func (j *jsonWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// csvWriter writes results in csv format
+type csvWriter struct {
+	mu     sync.Mutex
+	f      io.WriteCloser
+	w      *csv.Writer
+	closed bool
+}
+
+// Write writes a result as a csv row
+func (c *csvWriter) Write(r QueryResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return os.ErrClosed
+	}
+	o := newOutputRecord(r)
+	scheduled := ""
+	if o.Scheduled != nil {
+		scheduled = o.Scheduled.Format(time.RFC3339Nano)
+	}
+	row := []string{
+		o.Timestamp.Format(time.RFC3339Nano),
+		o.Group,
+		o.DB,
+		strconv.Itoa(o.Iteration),
+		o.Query,
+		strconv.FormatFloat(o.Duration, 'f', 6, 64),
+		strconv.FormatInt(o.Rows, 10),
+		o.SQLState,
+		o.Error,
+		scheduled,
+		o.Name,
+		o.Transaction,
+		strconv.Itoa(o.Statement),
+		strconv.Itoa(o.Retries),
+		strconv.FormatInt(o.Bytes, 10),
+		strconv.FormatFloat(o.FirstRow, 'f', 6, 64),
+		o.TLS,
+		strconv.FormatBool(o.Timeout),
+		o.ErrorClass,
+		o.Protocol,
+		o.Type,
+	}
+	// leave the interval columns empty
+	return c.w.Write(append(row, make([]string, len(csvHeader)-len(row))...))
+}
+
+// WriteInterval writes an interval report as a csv row
+func (c *csvWriter) WriteInterval(r IntervalReport) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return os.ErrClosed
+	}
+	o := newIntervalRecord(r)
+	seconds := func(f float64) string { return strconv.FormatFloat(f, 'f', 6, 64) }
+	fields := map[string]string{
+		"timestamp": o.Timestamp.Format(time.RFC3339Nano),
+		"group":     o.Group,
+		"type":      o.Type,
+		"interval":  seconds(o.Interval),
+		"queries":   strconv.FormatInt(o.Queries, 10),
+		"errors":    strconv.FormatInt(o.Errors, 10),
+		"timeouts":  strconv.FormatInt(o.Timeouts, 10),
+		"qps":       strconv.FormatFloat(o.QPS, 'f', 3, 64),
+		"p50":       seconds(o.P50),
+		"p95":       seconds(o.P95),
+		"p99":       seconds(o.P99),
+	}
+	if o.Server != nil {
+		for name, v := range o.Server.fields() {
+			fields[name] = v
+		}
+	}
+	row := make([]string, len(csvHeader))
+	for name, v := range fields {
+		row[csvColumn(name)] = v
+	}
+	return c.w.Write(row)
+}
+
+// csvColumn returns the index of a column in csvHeader
+func csvColumn(name string) int {
+	for i, n := range csvHeader {
+		if n == name {
+			return i
+		}
+	}
+	panic("unknown csv column " + name)
+}
+
+// Close flushes buffered rows and closes the underlying file
+func (c *csvWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// result converts an outputRecord back to a QueryResult, for the
+// fields needed to aggregate results
+func (o outputRecord) result() QueryResult {
+	r := QueryResult{
+		Group:       o.Group,
+		Database:    o.DB,
+		Iteration:   o.Iteration,
+		Query:       o.Query,
+		QueryName:   o.Name,
+		Start:       o.Timestamp,
+		Duration:    time.Duration(o.Duration * float64(time.Second)),
+		Rows:        o.Rows,
+		Bytes:       o.Bytes,
+		FirstRow:    time.Duration(o.FirstRow * float64(time.Second)),
+		SQLState:    o.SQLState,
+		Transaction: o.Transaction,
+		Statement:   o.Statement,
+		Retries:     o.Retries,
+		TLS:         o.TLS,
+		Timeout:     o.Timeout,
+		Protocol:    o.Protocol,
+	}
+	if o.Error != "" {
+		r.Err = errors.New(o.Error)
+	}
+	if o.Scheduled != nil {
+		r.Scheduled = *o.Scheduled
+	}
+	if o.Query == "" && o.Error != "" {
+		r.QueryIndex = -1 // connection error
+	}
+	return r
+}
+
+// ReadResults reads the results written to a file in the given format.
+// If format is empty it is determined from the file extension.
+func ReadResults(path, format string) ([]QueryResult, error) {
+	format, err := resultFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []outputRecord
+	switch format {
+	case "jsonl":
+		records, err = readJSON(f)
+	case "csv":
+		records, err = readCSV(f)
+	default:
+		return nil, fmt.Errorf("unknown output format %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	results := make([]QueryResult, len(records))
+	for i, o := range records {
+		results[i] = o.result()
+	}
+	return results, nil
+}
+
+// readJSON reads records in JSON Lines format, skipping interval
+// reports
+func readJSON(r io.Reader) ([]outputRecord, error) {
+	records := []outputRecord{}
+	dec := json.NewDecoder(r)
+	for {
+		var o outputRecord
+		err := dec.Decode(&o)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o.Type != "" {
+			continue
+		}
+		records = append(records, o)
+	}
+}
+
+// readCSV reads records in csv format, skipping interval reports and
+// finding the fields by the names in the header row so that files with
+// fewer columns, written by earlier versions, can be read
+func readCSV(r io.Reader) ([]outputRecord, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range []string{"timestamp", "group", "query", "duration"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", name)
+		}
+	}
+
+	records := []outputRecord{}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		if field("type") != "" {
+			continue
+		}
+		var invalid []string
+		number := func(name string) float64 {
+			if field(name) == "" {
+				return 0
+			}
+			f, err := strconv.ParseFloat(field(name), 64)
+			if err != nil {
+				invalid = append(invalid, name)
+			}
+			return f
+		}
+		timestamp := func(name string) time.Time {
+			t, err := time.Parse(time.RFC3339Nano, field(name))
+			if err != nil {
+				invalid = append(invalid, name)
+			}
+			return t
+		}
+		o := outputRecord{
+			Timestamp:   timestamp("timestamp"),
+			Group:       field("group"),
+			DB:          field("db"),
+			Iteration:   int(number("iteration")),
+			Query:       field("query"),
+			Duration:    number("duration"),
+			Rows:        int64(number("rows")),
+			SQLState:    field("sqlstate"),
+			Error:       field("error"),
+			Name:        field("name"),
+			Transaction: field("transaction"),
+			Statement:   int(number("statement")),
+			Retries:     int(number("retries")),
+			Bytes:       int64(number("bytes")),
+			FirstRow:    number("first_row"),
+			TLS:         field("tls"),
+			Timeout:     field("timeout") == "true",
+			ErrorClass:  field("error_class"),
+			Protocol:    field("protocol"),
+		}
+		if field("scheduled") != "" {
+			scheduled := timestamp("scheduled")
+			o.Scheduled = &scheduled
+		}
+		if len(invalid) > 0 {
+			return nil, fmt.Errorf("line %d: invalid %s", line, strings.Join(invalid, ", "))
+		}
+		records = append(records, o)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testResults = []QueryResult{
+	{
+		Group: "g1", Database: "db1", Iteration: 1, Query: "select 1",
+		Start: time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC), Duration: 2 * time.Millisecond, Rows: 1,
+		TLS: "TLSv1.3", Protocol: "describe",
+	},
+	{
+		Group: "g1", Database: "db1", Iteration: 1, Query: "select x",
+		Start: time.Date(2022, 8, 1, 12, 0, 1, 0, time.UTC), Err: errors.New("no column x"), SQLState: "42703",
+	},
+	{
+		Group: "g1", Database: "db1", Iteration: 1, Query: "select pg_sleep(10)",
+		Start: time.Date(2022, 8, 1, 12, 0, 2, 0, time.UTC), Duration: time.Second,
+		Err: errors.New("canceling statement due to statement timeout"), SQLState: "57014", Timeout: true,
+	},
+}
+
+func writeResults(t *testing.T, path, format string) {
+	t.Helper()
+	w, err := NewResultWriter(path, format)
+	if err != nil {
+		t.Fatalf("could not make writer: %s", err)
+	}
+	for _, r := range testResults {
+		if err := w.Write(r); err != nil {
+			t.Errorf("write error: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("close error: %s", err)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	writeResults(t, path, "")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := []outputRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var o outputRecord
+		if err := json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			t.Fatalf("could not decode line: %s", err)
+		}
+		records = append(records, o)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	if records[0].Duration != 0.002 || records[0].Rows != 1 || records[0].Error != "" || records[0].TLS != "TLSv1.3" {
+		t.Errorf("unexpected first record %+v", records[0])
+	}
+	if records[1].Error != "no column x" || records[1].SQLState != "42703" || records[1].Timeout {
+		t.Errorf("unexpected second record %+v", records[1])
+	}
+	if records[1].ErrorClass != "syntax" {
+		t.Errorf("second record error class %s should be syntax", records[1].ErrorClass)
+	}
+	if !records[2].Timeout {
+		t.Errorf("third record %+v should be a timeout", records[2])
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.out")
+	writeResults(t, path, "csv")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows, got %d", len(rows))
+	}
+	if rows[0][0] != "timestamp" {
+		t.Errorf("expected header row, got %v", rows[0])
+	}
+	if rows[1][5] != "0.002000" {
+		t.Errorf("duration %s should be 0.002000", rows[1][5])
+	}
+	if rows[2][8] != "no column x" {
+		t.Errorf("error %s should be 'no column x'", rows[2][8])
+	}
+	col := map[string]int{}
+	for i, name := range rows[0] {
+		col[name] = i
+	}
+	if tls := rows[1][col["tls"]]; tls != "TLSv1.3" {
+		t.Errorf("tls %s should be TLSv1.3", tls)
+	}
+	if timeout := rows[3][col["timeout"]]; timeout != "true" {
+		t.Errorf("timeout %s should be true", timeout)
+	}
+	if class := rows[2][col["error_class"]]; class != "syntax" {
+		t.Errorf("error class %s should be syntax", class)
+	}
+	if protocol := rows[1][col["protocol"]]; protocol != "describe" {
+		t.Errorf("protocol %s should be describe", protocol)
+	}
+}
+
+func TestReadResults(t *testing.T) {
+	for _, ext := range []string{"jsonl", "csv"} {
+		path := filepath.Join(t.TempDir(), "results."+ext)
+		writeResults(t, path, "")
+
+		results, err := ReadResults(path, "")
+		if err != nil {
+			t.Fatalf("%s: %s", ext, err)
+		}
+		if len(results) != len(testResults) {
+			t.Fatalf("%s: expected %d results, got %d", ext, len(testResults), len(results))
+		}
+		for i, r := range results {
+			expect := testResults[i]
+			if r.Group != expect.Group || r.Query != expect.Query || !r.Start.Equal(expect.Start) ||
+				r.Duration != expect.Duration || r.Timeout != expect.Timeout || r.Protocol != expect.Protocol ||
+				(r.Err == nil) != (expect.Err == nil) {
+				t.Errorf("%s: result %d got %+v expected %+v", ext, i, r, expect)
+			}
+		}
+	}
+}
+
+func TestWriteInterval(t *testing.T) {
+	report := IntervalReport{
+		Group: "g1", Start: time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC),
+		Elapsed: 10 * time.Second, Interval: 10 * time.Second,
+	}
+	for i := 0; i < 20; i++ {
+		report.Record(2 * time.Millisecond)
+	}
+	report.Errors = 1
+	report.Server = newServerStats()
+	report.Server.add(testServerSample(4, 1, 0, map[string]int64{"Lock:transactionid": 2}, DatabaseStats{Commits: 20}))
+
+	for _, ext := range []string{"jsonl", "csv"} {
+		path := filepath.Join(t.TempDir(), "results."+ext)
+		w, err := NewResultWriter(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(testResults[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteInterval(report); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		interval := lines[len(lines)-1]
+		switch ext {
+		case "jsonl":
+			var o intervalRecord
+			if err := json.Unmarshal([]byte(interval), &o); err != nil {
+				t.Fatal(err)
+			}
+			if o.Type != "interval" || o.Group != "g1" || o.Interval != 10 || o.Queries != 20 ||
+				o.Errors != 1 || o.QPS != 2 || o.P99 != 0.002 {
+				t.Errorf("unexpected interval record %+v", o)
+			}
+			if o.Server == nil || o.Server.Active != 4 || o.Server.Waits["Lock:transactionid"] != 2 || o.Server.Commits != 20 {
+				t.Errorf("unexpected interval server record %+v", o.Server)
+			}
+		case "csv":
+			rows, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			col := map[string]int{}
+			for i, name := range rows[0] {
+				col[name] = i
+			}
+			row := rows[2]
+			for name, expect := range map[string]string{
+				"group": "g1", "query": "", "type": "interval", "interval": "10.000000",
+				"queries": "20", "errors": "1", "qps": "2.000", "p99": "0.002000",
+				"server_samples": "1", "server_active": "4.000", "server_waits": "Lock:transactionid=2.000",
+				"server_commits": "20",
+			} {
+				if row[col[name]] != expect {
+					t.Errorf("interval %s %q should be %q", name, row[col[name]], expect)
+				}
+			}
+		}
+
+		// interval reports are not read as results
+		results, err := ReadResults(path, "")
+		if err != nil {
+			t.Fatalf("%s: %s", ext, err)
+		}
+		if len(results) != 1 {
+			t.Errorf("%s: expected 1 result, got %d", ext, len(results))
+		}
+	}
+}
+
+func TestResultWriterFormat(t *testing.T) {
+	if _, err := NewResultWriter(filepath.Join(t.TempDir(), "results.txt"), ""); err == nil {
+		t.Error("unknown extension should fail")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCharset is the character set of random strings
+const defaultCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// placeholderRegexp matches query placeholders such as $1
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// dollarQuoteRegexp matches the opening tag of a dollar quoted string,
+// such as $$ or $body$
+var dollarQuoteRegexp = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// ParamConfig sets out the generator for a query parameter. Type is one
+// of:
+//
+//	int:       random integer from min to max inclusive, uniformly
+//	zipf:      random integer from min to max inclusive, with a zipfian
+//	           distribution of exponent s (default 1.1) favouring min
+//	choice:    random choice from values
+//	sequence:  integers from start, incremented by step (default 1)
+//	string:    random string of length characters from charset
+//	timestamp: random time from from to to (default the last 24 hours)
+//	csv:       random value from column (default the first) of the csv
+//	           file, which has a header row
+type ParamConfig struct {
+	Type    string
+	Min     int64
+	Max     int64
+	S       float64
+	Values  []interface{}
+	Start   int64
+	Step    int64
+	Length  int
+	Charset string
+	From    time.Time
+	To      time.Time
+	File    string
+	Column  string
+}
+
+// check checks the validity of the parameter settings
+func (p ParamConfig) check() error {
+	switch p.Type {
+	case "int", "zipf":
+		if p.Max < p.Min {
+			return fmt.Errorf("%s parameter max is less than min", p.Type)
+		}
+		// the number of values in the range must fit in an int64
+		if p.Min <= 0 && p.Max > math.MaxInt64-1+p.Min {
+			return fmt.Errorf("%s parameter range is too wide", p.Type)
+		}
+		if p.Type == "zipf" && p.S != 0 && p.S <= 1 {
+			return fmt.Errorf("zipf parameter s must be greater than 1")
+		}
+	case "choice":
+		if len(p.Values) == 0 {
+			return fmt.Errorf("choice parameter has no values")
+		}
+	case "sequence":
+	case "string":
+		if p.Length < 1 {
+			return fmt.Errorf("string parameter requires a length")
+		}
+	case "timestamp":
+		if !p.From.IsZero() && !p.To.IsZero() && p.To.Before(p.From) {
+			return fmt.Errorf("timestamp parameter to is before from")
+		}
+		// to defaults to the time each value is generated
+		if !p.From.IsZero() && p.To.IsZero() && !p.From.Before(time.Now()) {
+			return fmt.Errorf("timestamp parameter from is in the future, with to unset")
+		}
+		// the number of nanoseconds in the range must fit in an int64
+		if !p.From.IsZero() && !p.To.IsZero() && p.To.Sub(p.From) == math.MaxInt64 {
+			return fmt.Errorf("timestamp parameter range is too wide")
+		}
+	case "csv":
+		if p.File == "" {
+			return fmt.Errorf("csv parameter requires a file")
+		}
+	default:
+		return fmt.Errorf("unknown parameter type %q", p.Type)
+	}
+	return nil
+}
+
+// Generator generates query parameter values
+type Generator interface {
+	Next() interface{}
+}
+
+// randGenerator is a generator using a random source. It is safe for
+// concurrent use.
+type randGenerator struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+	next func(r *rand.Rand) interface{}
+}
+
+// Next returns the next random value
+func (g *randGenerator) Next() interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.next(g.rand)
+}
+
+// newRandGenerator returns a randGenerator
+func newRandGenerator(next func(r *rand.Rand) interface{}) *randGenerator {
+	return &randGenerator{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		next: next,
+	}
+}
+
+// sequenceGenerator generates a sequence of integers. It is safe for
+// concurrent use.
+type sequenceGenerator struct {
+	mu   sync.Mutex
+	next int64
+	step int64
+}
+
+// Next returns the next value in the sequence
+func (g *sequenceGenerator) Next() interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v := g.next
+	g.next += g.step
+	return v
+}
+
+// newGenerator returns a generator for the parameter settings
+func newGenerator(p ParamConfig) (Generator, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	switch p.Type {
+	case "int":
+		return newRandGenerator(func(r *rand.Rand) interface{} {
+			return p.Min + r.Int63n(p.Max-p.Min+1)
+		}), nil
+	case "zipf":
+		s := p.S
+		if s == 0 {
+			s = 1.1
+		}
+		g := newRandGenerator(nil)
+		zipf := rand.NewZipf(g.rand, s, 1, uint64(p.Max-p.Min))
+		g.next = func(r *rand.Rand) interface{} {
+			return p.Min + int64(zipf.Uint64())
+		}
+		return g, nil
+	case "choice":
+		return newRandGenerator(func(r *rand.Rand) interface{} {
+			return p.Values[r.Intn(len(p.Values))]
+		}), nil
+	case "sequence":
+		step := p.Step
+		if step == 0 {
+			step = 1
+		}
+		return &sequenceGenerator{next: p.Start, step: step}, nil
+	case "string":
+		charset := p.Charset
+		if charset == "" {
+			charset = defaultCharset
+		}
+		chars := []rune(charset)
+		return newRandGenerator(func(r *rand.Rand) interface{} {
+			s := make([]rune, p.Length)
+			for i := range s {
+				s[i] = chars[r.Intn(len(chars))]
+			}
+			return string(s)
+		}), nil
+	case "timestamp":
+		return newRandGenerator(func(r *rand.Rand) interface{} {
+			from, to := p.From, p.To
+			if to.IsZero() {
+				to = time.Now()
+			}
+			if from.IsZero() {
+				from = to.Add(-24 * time.Hour)
+			}
+			return from.Add(time.Duration(r.Int63n(int64(to.Sub(from)) + 1)))
+		}), nil
+	case "csv":
+		values, err := readCSVColumn(p.File, p.Column)
+		if err != nil {
+			return nil, err
+		}
+		return newRandGenerator(func(r *rand.Rand) interface{} {
+			return values[r.Intn(len(values))]
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown parameter type %q", p.Type)
+}
+
+// readCSVColumn reads the values of a column from a csv file with a
+// header row, using the first column if column is empty
+func readCSVColumn(file, column string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read csv header from %s: %w", file, err)
+	}
+	index := 0
+	if column != "" {
+		index = -1
+		for i, h := range header {
+			if h == column {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("column %s not found in %s", column, file)
+		}
+	}
+
+	values := []string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", file, err)
+		}
+		values = append(values, record[index])
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no values found in %s", file)
+	}
+	return values, nil
+}
+
+// stripQuoted returns the sql with its string literals, quoted
+// identifiers, dollar quoted strings and comments replaced by spaces,
+// so that text such as '$5 off' is not taken for a placeholder
+func stripQuoted(sql string) string {
+	var b strings.Builder
+	for i := 0; i < len(sql); {
+		end := i + 1
+		switch rest := sql[i:]; {
+		case rest[0] == '\'' || rest[0] == '"':
+			// doubled quotes are escapes, read as two adjacent strings
+			if j := strings.IndexByte(rest[1:], rest[0]); j >= 0 {
+				end = i + j + 2
+			} else {
+				end = len(sql)
+			}
+		case strings.HasPrefix(rest, "--"):
+			if j := strings.IndexByte(rest, '\n'); j >= 0 {
+				end = i + j
+			} else {
+				end = len(sql)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			depth := 0
+			for end = i; end < len(sql); end++ {
+				if strings.HasPrefix(sql[end:], "/*") {
+					depth++
+					end++
+				} else if strings.HasPrefix(sql[end:], "*/") {
+					depth--
+					end++
+					if depth == 0 {
+						end++
+						break
+					}
+				}
+			}
+		case dollarQuoteRegexp.MatchString(rest):
+			tag := dollarQuoteRegexp.FindString(rest)
+			if j := strings.Index(rest[len(tag):], tag); j >= 0 {
+				end = i + len(tag) + j + len(tag)
+			} else {
+				end = len(sql)
+			}
+		default:
+			b.WriteByte(sql[i])
+			i++
+			continue
+		}
+		b.WriteByte(' ')
+		i = end
+	}
+	return b.String()
+}
+
+// checkPlaceholders checks that the placeholders in a query, outside of
+// quoted text and comments, match the number of parameters
+func checkPlaceholders(sql string, params int) error {
+	highest := 0
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(stripQuoted(sql), -1) {
+		if n, _ := strconv.Atoi(m[1]); n > highest {
+			highest = n
+		}
+	}
+	if highest != params {
+		return fmt.Errorf("query has %d placeholders but %d parameters", highest, params)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerators(t *testing.T) {
+
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		param ParamConfig
+		check func(v interface{}) bool
+	}{
+		{
+			param: ParamConfig{Type: "int", Min: 5, Max: 7},
+			check: func(v interface{}) bool { i := v.(int64); return i >= 5 && i <= 7 },
+		},
+		{
+			param: ParamConfig{Type: "zipf", Min: 100, Max: 200},
+			check: func(v interface{}) bool { i := v.(int64); return i >= 100 && i <= 200 },
+		},
+		{
+			param: ParamConfig{Type: "choice", Values: []interface{}{"a", 2}},
+			check: func(v interface{}) bool { return v == "a" || v == 2 },
+		},
+		{
+			param: ParamConfig{Type: "string", Length: 8, Charset: "xy"},
+			check: func(v interface{}) bool {
+				s := v.(string)
+				return len(s) == 8 && strings.Trim(s, "xy") == ""
+			},
+		},
+		{
+			param: ParamConfig{Type: "timestamp", From: from, To: to},
+			check: func(v interface{}) bool {
+				ts := v.(time.Time)
+				return !ts.Before(from) && !ts.After(to)
+			},
+		},
+	} {
+		g, err := newGenerator(test.param)
+		if err != nil {
+			t.Fatalf("%s generator error: %s", test.param.Type, err)
+		}
+		for i := 0; i < 100; i++ {
+			if v := g.Next(); !test.check(v) {
+				t.Errorf("%s generator value %v unexpected", test.param.Type, v)
+				break
+			}
+		}
+	}
+}
+
+func TestSequenceGenerator(t *testing.T) {
+	g, err := newGenerator(ParamConfig{Type: "sequence", Start: 10, Step: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []int64{10, 15, 20} {
+		if v := g.Next(); v != expect {
+			t.Errorf("sequence value %v should be %d", v, expect)
+		}
+	}
+}
+
+func TestCSVGenerator(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ids.csv")
+	if err := os.WriteFile(file, []byte("name,id\nx,1\ny,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newGenerator(ParamConfig{Type: "csv", File: file, Column: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if v := g.Next(); v != "1" && v != "2" {
+			t.Errorf("csv value %v should be 1 or 2", v)
+		}
+	}
+
+	if _, err := newGenerator(ParamConfig{Type: "csv", File: file, Column: "nonsense"}); err == nil {
+		t.Error("missing csv column should fail")
+	}
+}
+
+func TestParamCheck(t *testing.T) {
+	for i, p := range []ParamConfig{
+		{Type: "int", Min: 10, Max: 1},
+		{Type: "int", Min: math.MinInt64, Max: math.MaxInt64},
+		{Type: "zipf", Min: -1, Max: math.MaxInt64},
+		{Type: "timestamp", From: time.Now().Add(time.Hour)},
+		{Type: "timestamp", From: time.Date(1700, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Type: "zipf", Max: 10, S: 0.5},
+		{Type: "choice"},
+		{Type: "string"},
+		{Type: "csv"},
+		{Type: "uuid"},
+	} {
+		if err := p.check(); err == nil {
+			t.Errorf("param %d should be invalid", i)
+		}
+	}
+	for i, p := range []ParamConfig{
+		{Type: "int", Min: 0, Max: math.MaxInt64 - 1},
+		{Type: "int", Min: 1, Max: math.MaxInt64},
+		{Type: "timestamp", From: time.Now().Add(-time.Hour)},
+		{Type: "timestamp", From: time.Now().Add(time.Hour), To: time.Now().Add(2 * time.Hour)},
+	} {
+		if err := p.check(); err != nil {
+			t.Errorf("param %d should be valid: %s", i, err)
+		}
+	}
+}
+
+func TestCheckPlaceholders(t *testing.T) {
+	if err := checkPlaceholders("select * from t where a = $1 and b = $2 or c = $1", 2); err != nil {
+		t.Errorf("placeholders should match: %s", err)
+	}
+	if err := checkPlaceholders("select * from t where a = $1 and b = $3", 2); err == nil {
+		t.Error("placeholders should not match")
+	}
+	for _, sql := range []string{
+		"select '$5 off'",
+		"select 'it''s $5', \"col$2\" from t",
+		"select $$ $3 $$, $body$ select $4 $body$",
+		"select 1 -- costs $2\n",
+		"select /* $1 /* $2 */ */ 1",
+	} {
+		if err := checkPlaceholders(sql, 0); err != nil {
+			t.Errorf("%s: quoted text should be ignored: %s", sql, err)
+		}
+	}
+	if err := checkPlaceholders("select '$5 off' where a = $1 -- $2", 1); err != nil {
+		t.Errorf("placeholder outside quotes should count: %s", err)
+	}
+	if err := checkPlaceholders("select 'x' || $1", 0); err == nil {
+		t.Error("placeholder without parameters should not match")
+	}
+}
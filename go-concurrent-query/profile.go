@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// profileTick is the interval at which a query group's concurrency and
+// rate are adjusted to follow its load profile
+var profileTick = 100 * time.Millisecond
+
+// Profile is a series of load stages for a query group
+type Profile []Stage
+
+// Stage is a load profile stage, setting the concurrency and optionally
+// the target rate of a query group over a duration. An unset
+// concurrency or rate holds the level of the previous stage.
+//
+// Ramp sets how the stage's levels are reached:
+//
+//	step:   jump to the stage levels at the start of the stage (default)
+//	linear: change linearly from the previous levels over the stage
+//	spike:  jump to the stage levels, returning to the previous levels
+//	        at the end of the stage
+type Stage struct {
+	Duration    time.Duration
+	Concurrency int
+	Rate        Rate
+	Ramp        string
+}
+
+// level is a concurrency and rate setting
+type level struct {
+	concurrency float64
+	rate        float64
+}
+
+// check checks the validity of the profile stages
+func (p Profile) check() error {
+	for i, s := range p {
+		if s.Duration <= 0 {
+			return fmt.Errorf("profile stage %d requires a positive duration", i+1)
+		}
+		if s.Concurrency < 0 {
+			return fmt.Errorf("profile stage %d concurrency cannot be negative", i+1)
+		}
+		switch s.Ramp {
+		case "", "step", "linear", "spike":
+		default:
+			return fmt.Errorf("profile stage %d has unknown ramp %q", i+1, s.Ramp)
+		}
+	}
+	return nil
+}
+
+// peak returns the highest concurrency reached by the profile, starting
+// from the initial concurrency
+func (p Profile) peak(concurrency int) int {
+	for _, s := range p {
+		if s.Concurrency > concurrency {
+			concurrency = s.Concurrency
+		}
+	}
+	return concurrency
+}
+
+// At returns the concurrency and rate for the elapsed time since the
+// start of the profile, starting from the initial concurrency and rate.
+// Once the profile is complete its final levels are held.
+func (p Profile) At(elapsed time.Duration, concurrency int, rate Rate) (int, Rate) {
+	prev := level{float64(concurrency), float64(rate)}
+	for _, s := range p {
+		target := prev
+		if s.Concurrency > 0 {
+			target.concurrency = float64(s.Concurrency)
+		}
+		if s.Rate > 0 {
+			target.rate = float64(s.Rate)
+		}
+		if elapsed < s.Duration {
+			current := target
+			if s.Ramp == "linear" {
+				f := float64(elapsed) / float64(s.Duration)
+				current.concurrency = prev.concurrency + f*(target.concurrency-prev.concurrency)
+				current.rate = prev.rate + f*(target.rate-prev.rate)
+			}
+			return int(math.Round(current.concurrency)), Rate(current.rate)
+		}
+		elapsed -= s.Duration
+		if s.Ramp != "spike" {
+			prev = target
+		}
+	}
+	return int(math.Round(prev.concurrency)), Rate(prev.rate)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestProfileAt(t *testing.T) {
+
+	profile := Profile{
+		{Duration: 10 * time.Second, Concurrency: 11, Ramp: "linear"},
+		{Duration: 10 * time.Second},
+		{Duration: 5 * time.Second, Concurrency: 50, Rate: 100, Ramp: "spike"},
+		{Duration: 10 * time.Second, Rate: 200},
+	}
+
+	for i, test := range []struct {
+		elapsed     time.Duration
+		concurrency int
+		rate        Rate
+	}{
+		{elapsed: 0, concurrency: 1, rate: 10},
+		{elapsed: 5 * time.Second, concurrency: 6, rate: 10},
+		{elapsed: 10 * time.Second, concurrency: 11, rate: 10},
+		{elapsed: 15 * time.Second, concurrency: 11, rate: 10},
+		{elapsed: 21 * time.Second, concurrency: 50, rate: 100},
+		{elapsed: 26 * time.Second, concurrency: 11, rate: 200},
+		{elapsed: time.Hour, concurrency: 11, rate: 200},
+	} {
+		c, r := profile.At(test.elapsed, 1, 10)
+		if c != test.concurrency || r != test.rate {
+			t.Errorf("test %d at %s got %d %g expected %d %g",
+				i, test.elapsed, c, r, test.concurrency, test.rate)
+		}
+	}
+}
+
+func TestProfileYaml(t *testing.T) {
+
+	inlineYaml := `
+databases: [db1]
+concurrency: 1
+iterations: 1
+queries: [select 1]
+profile:
+  - duration: 5m
+    concurrency: 50
+    ramp: linear
+  - duration: 10m
+  - duration: 30s
+    concurrency: 200
+    rate: 1000/s
+    ramp: spike
+`
+	var g DBQueryGroupConfig
+	if err := yaml.Unmarshal([]byte(inlineYaml), &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Profile) != 3 {
+		t.Fatalf("expected 3 stages, got %d", len(g.Profile))
+	}
+	if g.Profile[0].Duration != 5*time.Minute || g.Profile[0].Ramp != "linear" {
+		t.Errorf("unexpected first stage %+v", g.Profile[0])
+	}
+	if g.Profile[2].Rate != 1000 || g.Profile[2].Concurrency != 200 {
+		t.Errorf("unexpected third stage %+v", g.Profile[2])
+	}
+	if err := g.Profile.check(); err != nil {
+		t.Errorf("profile should be valid: %s", err)
+	}
+}
+
+func TestProfilePeak(t *testing.T) {
+	p := Profile{
+		{Duration: time.Minute, Concurrency: 50, Ramp: "linear"},
+		{Duration: time.Minute},
+		{Duration: time.Second, Concurrency: 200, Ramp: "spike"},
+		{Duration: time.Minute, Concurrency: 10},
+	}
+	if peak := p.peak(1); peak != 200 {
+		t.Errorf("peak %d should be 200", peak)
+	}
+	if peak := p.peak(300); peak != 300 {
+		t.Errorf("peak %d should be the initial 300", peak)
+	}
+	if peak := (Profile{}).peak(4); peak != 4 {
+		t.Errorf("peak %d without stages should be 4", peak)
+	}
+}
+
+func TestProfileCheck(t *testing.T) {
+	for i, p := range []Profile{
+		{{Duration: 0, Concurrency: 1}},
+		{{Duration: time.Second, Concurrency: -1}},
+		{{Duration: time.Second, Ramp: "exponential"}},
+	} {
+		if err := p.check(); err == nil {
+			t.Errorf("profile %d should be invalid", i)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+)
+
+// protocols describes the protocol modes in which a group's queries may
+// be run. Without a protocol pgx runs queries with arguments as cached
+// prepared statements and other non-fetch queries with the simple
+// protocol.
+var protocols = map[string]string{
+	"simple":   "simple query protocol, with arguments interpolated by the client",
+	"unnamed":  "extended protocol, preparing an unnamed statement for each query",
+	"prepare":  "extended protocol, with named prepared statements cached per connection",
+	"describe": "extended protocol, with statement descriptions cached per connection and unnamed statements",
+}
+
+// statementCacheCapacity is the number of statements cached for each
+// connection in the prepare and describe protocol modes
+var statementCacheCapacity = 512
+
+// setProtocol configures a connection to run queries in a protocol
+// mode, leaving the configuration unchanged for an empty protocol
+func setProtocol(config *pgx.ConnConfig, protocol string) {
+	cache := func(mode int) pgx.BuildStatementCacheFunc {
+		return func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, mode, statementCacheCapacity)
+		}
+	}
+	switch protocol {
+	case "simple":
+		config.PreferSimpleProtocol = true
+	case "unnamed":
+		config.PreferSimpleProtocol = false
+		config.BuildStatementCache = nil
+	case "prepare":
+		config.PreferSimpleProtocol = false
+		config.BuildStatementCache = cache(stmtcache.ModePrepare)
+	case "describe":
+		config.PreferSimpleProtocol = false
+		config.BuildStatementCache = cache(stmtcache.ModeDescribe)
+	}
+}
+
+// execRows runs a query with ex through the query path, discarding any
+// rows and returning the number of rows affected. Unlike Exec, which
+// always uses the simple protocol for queries without arguments, this
+// runs every query in the connection's protocol mode.
+func execRows(ctx context.Context, ex execer, sql string, args []interface{}) (int64, error) {
+	r, err := ex.Query(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for r.Next() {
+	}
+	r.Close()
+	return r.CommandTag().RowsAffected(), r.Err()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestSetProtocol(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		simple   bool
+		cache    bool
+		mode     int
+	}{
+		{"", false, true, stmtcache.ModePrepare},
+		{"simple", true, true, stmtcache.ModePrepare},
+		{"unnamed", false, false, 0},
+		{"prepare", false, true, stmtcache.ModePrepare},
+		{"describe", false, true, stmtcache.ModeDescribe},
+	} {
+		config, err := pgx.ParseConfig("host=localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		setProtocol(config, test.protocol)
+		if config.PreferSimpleProtocol != test.simple {
+			t.Errorf("%s: simple protocol %t should be %t", test.protocol, config.PreferSimpleProtocol, test.simple)
+		}
+		if (config.BuildStatementCache != nil) != test.cache {
+			t.Errorf("%s: statement cache should be %t", test.protocol, test.cache)
+			continue
+		}
+		if test.cache {
+			if mode := config.BuildStatementCache(nil).Mode(); mode != test.mode {
+				t.Errorf("%s: cache mode %d should be %d", test.protocol, mode, test.mode)
+			}
+		}
+	}
+}
@@ -2,25 +2,292 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rorycl/pgtools/pgconnect"
 )
 
 // DBQuery details that are needed to make queries against a db
 type DBQuery struct {
-	DBName     string
-	DBURL      string
-	Iterations int
-	Queries    []string
+	DBName       string
+	DBURL        string           // connection url or keyword/value string
+	Certificate  *tls.Certificate // optional client certificate with an encrypted key
+	Iterations   int
+	Queries      []Query
+	Transactions []Transaction
+	InFlight     *InFlight     // optional in-flight query counter
+	Pool         *pgxpool.Pool // optional connection pool
+	Scheduler    *Scheduler    // optional query rate scheduler
+	Mix          *Mix          // optional weighted query mix
+	Session      SessionConfig // connection setup and teardown
+	Protocol     string        // optional protocol mode, see protocols
 }
 
-// setDBURL constructs a database connection url
-func (d *DBQuery) setDBURL(user, pass, host, port, database string) {
-	var tpl = "postgres://%s:%s@%s:%v/%s"
-	d.DBURL = fmt.Sprintf(tpl, user, pass, host, port, database)
+// Query is a query with generators for its parameters
+type Query struct {
+	SQL    string
+	Name   string
+	Fetch  bool // read the result rows
+	Params []Generator
+	Timeouts
+}
+
+// NewQueries makes queries from query configurations, with timeouts
+// not set by a query taken from defaults
+func NewQueries(configs []QueryConfig, defaults Timeouts) ([]Query, error) {
+	queries := []Query{}
+	for _, c := range configs {
+		q := Query{
+			SQL:      c.SQL,
+			Name:     c.Name,
+			Fetch:    c.Fetch,
+			Timeouts: c.Timeouts.withDefaults(defaults),
+		}
+		for _, p := range c.Params {
+			g, err := newGenerator(p)
+			if err != nil {
+				return nil, err
+			}
+			q.Params = append(q.Params, g)
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
+
+// args generates the arguments for the query
+func (q Query) args() []interface{} {
+	args := make([]interface{}, len(q.Params))
+	for i, g := range q.Params {
+		args[i] = g.Next()
+	}
+	return args
+}
+
+// setDBURL constructs a database connection string for a database
+// from the connection settings of its target server, loading any client
+// certificate with an encrypted key
+func (d *DBQuery) setDBURL(settings pgconnect.Settings, database string) error {
+	d.DBURL = settings.ConnString(database)
+	var err error
+	d.Certificate, err = settings.Certificate()
+	return err
+}
+
+// setCertificate sets the client certificate, if any, on the tls
+// configurations of a connection configuration and its fallbacks
+func (d DBQuery) setCertificate(config *pgconn.Config) {
+	configs := []*tls.Config{config.TLSConfig}
+	for _, f := range config.Fallbacks {
+		configs = append(configs, f.TLSConfig)
+	}
+	pgconnect.SetCertificate(d.Certificate, configs...)
+}
+
+// connConfig returns the connection configuration for the database
+func (d DBQuery) connConfig() (*pgx.ConnConfig, error) {
+	config, err := pgx.ParseConfig(d.DBURL)
+	if err != nil {
+		return nil, err
+	}
+	d.setCertificate(&config.Config)
+	setProtocol(config, d.Protocol)
+	return config, nil
+}
+
+// setPool makes a connection pool for the database using the pool
+// configuration settings, which is shared by copies of the DBQuery
+func (d *DBQuery) setPool(ctx context.Context, pc *PoolConfig, concurrency int) error {
+	config, err := pgxpool.ParseConfig(d.DBURL)
+	if err != nil {
+		return err
+	}
+	d.setCertificate(&config.ConnConfig.Config)
+	setProtocol(config.ConnConfig, d.Protocol)
+	config.AfterConnect = d.Session.setup
+	config.MinConns = pc.MinConns
+	config.MaxConns = pc.MaxConns
+	if config.MaxConns == 0 {
+		config.MaxConns = int32(concurrency)
+	}
+	if pc.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = pc.MaxConnLifetime
+	}
+	if pc.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = pc.MaxConnIdleTime
+	}
+	d.Pool, err = pgxpool.ConnectConfig(ctx, config)
+	return err
+}
+
+// closePool runs the teardown statements on the idle connections of
+// the pool and closes it
+func (d DBQuery) closePool() {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	for _, pc := range d.Pool.AcquireAllIdle(ctx) {
+		d.Session.teardown(ctx, pc.Conn())
+		pc.Release()
+	}
+	d.Pool.Close()
+}
+
+// connect returns a connection to the database, either from the pool
+// or by making a new connection, together with a function to release
+// or close the connection
+func (d DBQuery) connect(ctx context.Context) (*pgx.Conn, func(), error) {
+	if d.Pool != nil {
+		pc, err := d.Pool.Acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pc.Conn(), pc.Release, nil
+	}
+	config, err := d.connConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { conn.Close(context.Background()) }, nil
+}
+
+// SetupError is an error applying a session setting or running a setup
+// statement on a connection, as distinct from a failure to connect
+type SetupError struct {
+	Err error
+}
+
+// Error returns the error message
+func (e *SetupError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *SetupError) Unwrap() error { return e.Err }
+
+// isSetupError reports whether err is a session setup error
+func isSetupError(err error) bool {
+	var setupErr *SetupError
+	return errors.As(err, &setupErr)
+}
+
+// setup applies the settings and runs the setup statements on a new
+// connection, returning any error as a SetupError
+func (c SessionConfig) setup(ctx context.Context, conn *pgx.Conn) error {
+	names := []string{}
+	for name := range c.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := conn.Exec(ctx, "select set_config($1, $2, false)", name, c.Settings[name]); err != nil {
+			return &SetupError{fmt.Errorf("session setting %s: %w", name, err)}
+		}
+	}
+	for _, sql := range c.Setup {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			return &SetupError{fmt.Errorf("session setup %q: %w", sql, err)}
+		}
+	}
+	return nil
+}
+
+// teardown runs the teardown statements on a connection before it is
+// closed, stopping at the first error
+func (c SessionConfig) teardown(ctx context.Context, conn *pgx.Conn) error {
+	for _, sql := range c.Teardown {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("session teardown %q: %w", sql, err)
+		}
+	}
+	return nil
+}
+
+// session is a connection used for a database run, which tracks the
+// server statement_timeout set for its queries so that the setting is
+// only changed when a query's statement timeout differs from the last
+type session struct {
+	conn             *pgx.Conn
+	release          func()
+	pooled           bool
+	config           SessionConfig
+	tls              string        // negotiated tls version, empty if not tls
+	statementTimeout time.Duration // 0 if not set, -1 if unknown
+}
+
+// newSession returns a new session for the database. Pooled
+// connections are set up when they are made by the pool, and other
+// connections here, outside of the query timings.
+func (d DBQuery) newSession(ctx context.Context) (*session, error) {
+	conn, release, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d.Pool == nil {
+		if err := d.Session.setup(ctx, conn); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return &session{
+		conn:    conn,
+		release: release,
+		pooled:  d.Pool != nil,
+		config:  d.Session,
+		tls:     pgconnect.TLSVersion(conn.PgConn().Conn()),
+	}, nil
+}
+
+// setStatementTimeout sets the server statement_timeout for the
+// following queries, resetting it to the server default for 0
+func (s *session) setStatementTimeout(ctx context.Context, d time.Duration) error {
+	if d == s.statementTimeout {
+		return nil
+	}
+	sql := "reset statement_timeout"
+	if d > 0 {
+		ms := d.Milliseconds()
+		if ms < 1 {
+			ms = 1 // 0 would disable the timeout
+		}
+		sql = fmt.Sprintf("set statement_timeout = %d", ms)
+	}
+	if _, err := s.conn.Exec(ctx, sql); err != nil {
+		s.statementTimeout = -1
+		return err
+	}
+	s.statementTimeout = d
+	return nil
+}
+
+// close releases the session connection, first resetting any statement
+// timeout on a pooled connection so that it does not apply to the next
+// user of the connection, or running the teardown statements on a
+// connection which is to be closed
+func (s *session) close() {
+	if s.conn.IsClosed() {
+		s.release()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	switch {
+	case !s.pooled:
+		s.config.teardown(ctx, s.conn)
+	case s.statementTimeout != 0:
+		if _, err := s.conn.Exec(ctx, "reset statement_timeout"); err != nil {
+			s.conn.Close(context.Background()) // don't return it to the pool
+		}
+	}
+	s.release()
 }
 
 // checkConnection checks if the required database can be access
@@ -28,7 +295,11 @@ func (d *DBQuery) checkConnection() error {
 	if d.DBURL == "" {
 		return errors.New("the database url is empty")
 	}
-	conn, err := pgx.Connect(context.Background(), d.DBURL)
+	config, err := d.connConfig()
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(context.Background(), config)
 	if err != nil {
 		return err
 	}
@@ -39,12 +310,131 @@ func (d *DBQuery) checkConnection() error {
 	return nil
 }
 
-// Query queries a database, reporting errors on errorChan
-func (d DBQuery) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string) {
+// execer executes sql, either on a connection or in a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// fetch runs a query with ex and reads all of its rows, returning the
+// number of rows, the approximate number of bytes received and the time
+// to the first row
+func fetch(ctx context.Context, ex execer, sql string, args []interface{}) (rows, bytes int64, firstRow time.Duration, err error) {
+	t1 := time.Now()
+	r, err := ex.Query(ctx, sql, args...)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer r.Close()
+	for r.Next() {
+		if rows == 0 {
+			firstRow = time.Since(t1)
+		}
+		rows++
+		for _, v := range r.RawValues() {
+			bytes += int64(len(v))
+		}
+	}
+	r.Close()
+	return rows, bytes, firstRow, r.Err()
+}
+
+// cancelTimeout limits the time taken to send a cancel request for a
+// query interrupted by its context
+var cancelTimeout = 5 * time.Second
+
+// cancelQuery asks the server to cancel any query still running on an
+// interrupted connection, so that it does not continue after the run
+func cancelQuery(pc *pgconn.PgConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	pc.CancelRequest(ctx)
+}
+
+// queryCanceled is the SQLSTATE of a query cancelled by the server,
+// including by statement_timeout
+const queryCanceled = "57014"
+
+// exec executes a query with ex on the session connection, within the
+// query's timeouts, returning its result. False is returned if the
+// query was interrupted because the context is done. A query exceeding
+// its client timeout is cancelled, leaving the connection closed.
+func (d DBQuery) exec(ctx context.Context, sess *session, ex execer, label string, q Query) (QueryResult, bool) {
+	r := QueryResult{
+		Group:     label,
+		Database:  d.DBName,
+		Query:     q.SQL,
+		QueryName: q.Name,
+		Protocol:  d.Protocol,
+	}
+	if err := sess.setStatementTimeout(ctx, q.StatementTimeout); err != nil {
+		if ctx.Err() != nil {
+			return QueryResult{}, false
+		}
+		r.Start = time.Now()
+		r.Err = fmt.Errorf("setting statement timeout: %w", err)
+		r.SQLState = sqlState(err)
+		return r, true
+	}
+	qctx := ctx
+	if q.Timeout > 0 {
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, q.Timeout)
+		defer cancel()
+	}
+	d.InFlight.Begin(label, d.DBName)
+	t1 := time.Now()
+	var err error
+	if q.Fetch {
+		r.Rows, r.Bytes, r.FirstRow, err = fetch(qctx, ex, q.SQL, q.args())
+	} else if d.Protocol != "" {
+		r.Rows, err = execRows(qctx, ex, q.SQL, q.args())
+	} else {
+		var tag pgconn.CommandTag
+		tag, err = ex.Exec(qctx, q.SQL, q.args()...)
+		r.Rows = tag.RowsAffected()
+	}
+	t2 := time.Now()
+	d.InFlight.End(label, d.DBName)
+	if err != nil && ctx.Err() != nil {
+		// the run has been cancelled or has timed out
+		return QueryResult{}, false
+	}
+	r.Start = t1
+	r.Duration = t2.Sub(t1)
+	r.Err = err
+	r.SQLState = sqlState(err)
+	switch {
+	case err != nil && qctx.Err() != nil:
+		r.Timeout = true
+		cancelQuery(sess.conn.PgConn())
+	case r.SQLState == queryCanceled && q.StatementTimeout > 0:
+		r.Timeout = true
+	}
+	return r, true
+}
+
+// connectResult returns the result for a failed connection attempt
+// started at t0
+func (d DBQuery) connectResult(label string, t0 time.Time, err error) QueryResult {
+	return QueryResult{
+		Group:      label,
+		Database:   d.DBName,
+		QueryIndex: -1,
+		Start:      t0,
+		Duration:   time.Since(t0),
+		Err:        err,
+		SQLState:   sqlState(err),
+	}
+}
+
+// Query queries a database, reporting the outcome of each query and
+// transaction on resultChan and other errors on errorChan
+func (d DBQuery) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
 
 	defer func() {
 		if err := recover(); err != nil {
-			if e := ctx.Err().Error; e != nil {
+			if ctx.Err() != nil {
 				// context closing error
 				// errorChan <- fmt.Errorf("database error: %s", err)
 				return
@@ -57,27 +447,60 @@ func (d DBQuery) Query(ctx context.Context, label string, errorChan chan<- error
 		errorChan <- fmt.Errorf("db url for %s is empty", d.DBName)
 		return
 	}
-	conn, err := pgx.Connect(ctx, d.DBURL)
-	defer conn.Close(context.Background())
+	t0 := time.Now()
+	sess, err := d.newSession(ctx)
 	if err != nil {
-		errorChan <- fmt.Errorf("error connecting to %s : %s", d.DBName, err)
+		if ctx.Err() == nil {
+			resultChan <- d.connectResult(label, t0, err)
+		}
 		return
 	}
+	defer func() {
+		if sess != nil {
+			sess.close()
+		}
+	}()
+
+	// queries are followed by transactions in the query index
 	for i := 1; i <= d.Iterations; i++ {
-		for _, q := range d.Queries {
-			t1 := time.Now()
-			_, err = conn.Exec(ctx, q)
+		for _, j := range d.Mix.order(len(d.Queries) + len(d.Transactions)) {
+			if sess.conn.IsClosed() {
+				// reconnect after a client timeout closed the connection
+				sess.close()
+				t0 := time.Now()
+				if sess, err = d.newSession(ctx); err != nil {
+					if ctx.Err() == nil {
+						resultChan <- d.connectResult(label, t0, err)
+					}
+					return
+				}
+			}
+			scheduled, err := d.Scheduler.Wait(ctx)
 			if err != nil {
-				errorChan <- fmt.Errorf(
-					"error on %s executing %s: %s", d.DBName, q, err,
-				)
+				return
+			}
+			if j >= len(d.Queries) {
+				t := d.Transactions[j-len(d.Queries)]
+				base := QueryResult{
+					Group:      label,
+					Database:   d.DBName,
+					Iteration:  i,
+					QueryIndex: j,
+					Scheduled:  scheduled,
+					TLS:        sess.tls,
+				}
+				if !d.runTransaction(ctx, sess, label, t, base, resultChan) {
+					return
+				}
 				continue
 			}
-			t2 := time.Now()
-			resultChan <- fmt.Sprintf(
-				"[%-20s:%02d] %0.3fs %s",
-				label+":"+d.DBName, i, float64(t2.Sub(t1))/float64(time.Second), q,
-			)
+			r, ok := d.exec(ctx, sess, sess.conn, label, d.Queries[j])
+			if !ok {
+				cancelQuery(sess.conn.PgConn())
+				return
+			}
+			r.Iteration, r.QueryIndex, r.Scheduled, r.TLS = i, j, scheduled, sess.tls
+			resultChan <- r
 		}
 	}
 	return
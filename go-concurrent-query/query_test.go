@@ -9,6 +9,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/jackc/pgx/v4"
 )
 
 var (
@@ -51,10 +53,11 @@ func TestDBQuery(t *testing.T) {
 		DBName:     db, // a label
 		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
 		Iterations: 2,
-		Queries: []string{
-			"select 1",
-			"select * from pg_sleep(0.1)",
-			"select * from x",
+		Queries: []Query{
+			{SQL: "select 1"},
+			{SQL: "select * from pg_sleep(0.1)"},
+			{SQL: "select * from x"},
+			{SQL: "select $1::int", Params: []Generator{&sequenceGenerator{next: 1, step: 1}}},
 		},
 	}
 
@@ -64,7 +67,7 @@ func TestDBQuery(t *testing.T) {
 	}
 
 	errChan := make(chan error)
-	resultChan := make(chan string)
+	resultChan := make(chan QueryResult)
 	ctx, cancel := context.WithDeadline(
 		context.Background(),
 		time.Now().Add(1*time.Second),
@@ -86,6 +89,9 @@ LOOP:
 			errorCount++
 			t.Logf("error %s\n", e)
 		case r := <-resultChan:
+			if r.Err != nil {
+				errorCount++
+			}
 			t.Logf("result %s\n", r)
 		case <-ctx.Done():
 			cancel()
@@ -110,9 +116,9 @@ func TestDBQueryCancel(t *testing.T) {
 		DBName:     db, // a label
 		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
 		Iterations: 2,
-		Queries: []string{
-			"select 1",
-			"select * from pg_sleep(0.1)",
+		Queries: []Query{
+			{SQL: "select 1"},
+			{SQL: "select * from pg_sleep(0.1)"},
 		},
 	}
 
@@ -122,7 +128,7 @@ func TestDBQueryCancel(t *testing.T) {
 	}
 
 	errChan := make(chan error)
-	resultChan := make(chan string)
+	resultChan := make(chan QueryResult)
 	ctx, cancel := context.WithDeadline(
 		context.Background(),
 		time.Now().Add(100*time.Millisecond),
@@ -150,3 +156,343 @@ LOOP:
 		}
 	}
 }
+
+// TestDBQueryTransaction tests transactions in DBQuery.Query
+func TestDBQueryTransaction(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbq := DBQuery{
+		DBName:     db, // a label
+		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+		Iterations: 1,
+		Transactions: []Transaction{
+			{
+				Name:      "ok",
+				Isolation: pgx.Serializable,
+				Statements: []Query{
+					{SQL: "select 1"},
+					{SQL: "select 2"},
+				},
+			},
+			{
+				Name: "fails",
+				Statements: []Query{
+					{SQL: "select 1"},
+					{SQL: "select * from x"},
+					{SQL: "select 3"},
+				},
+			},
+		},
+	}
+
+	errChan := make(chan error)
+	resultChan := make(chan QueryResult)
+	ctx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(1*time.Second),
+	)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		dbq.Query(ctx, "test", errChan, resultChan)
+		done <- struct{}{}
+	}()
+
+	results := []QueryResult{}
+LOOP:
+	for {
+		select {
+		case <-done:
+			break LOOP
+		case e := <-errChan:
+			t.Errorf("error %s\n", e)
+		case r := <-resultChan:
+			results = append(results, r)
+			t.Logf("result %s\n", r)
+		case <-ctx.Done():
+			t.Errorf("deadline timed out")
+			break LOOP
+		}
+	}
+
+	// 2 statements and a transaction, then 2 statements and a failed
+	// transaction
+	if len(results) != 6 {
+		t.Fatalf("expected 6 results, got %d", len(results))
+	}
+	if !results[2].IsTransaction() || results[2].Err != nil {
+		t.Errorf("expected successful transaction, got %+v", results[2])
+	}
+	if !results[5].IsTransaction() || results[5].Err == nil {
+		t.Errorf("expected failed transaction, got %+v", results[5])
+	}
+}
+
+// TestDBQueryFetch tests reading rows with fetch queries
+func TestDBQueryFetch(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbq := DBQuery{
+		DBName:     db, // a label
+		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+		Iterations: 1,
+		Queries: []Query{
+			{SQL: "select repeat('x', 10) from generate_series(1, 100)", Fetch: true},
+			{SQL: "select repeat('x', 10) from generate_series(1, 100)"},
+		},
+	}
+
+	errChan := make(chan error)
+	resultChan := make(chan QueryResult)
+	ctx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(1*time.Second),
+	)
+	defer cancel()
+
+	go func() {
+		dbq.Query(ctx, "test", errChan, resultChan)
+		close(resultChan)
+	}()
+
+	results := []QueryResult{}
+	for r := range resultChan {
+		t.Logf("result %s rows %d bytes %d first row %s\n", r, r.Rows, r.Bytes, r.FirstRow)
+		results = append(results, r)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Rows != 100 || results[0].Bytes != 1000 || results[0].FirstRow == 0 {
+		t.Errorf("unexpected fetch result %+v", results[0])
+	}
+	if results[1].Bytes != 0 || results[1].FirstRow != 0 {
+		t.Errorf("unexpected exec result %+v", results[1])
+	}
+}
+
+// TestDBQueryTimeouts tests client and statement timeouts, and that a
+// query after a client timeout runs on a new connection
+func TestDBQueryTimeouts(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbq := DBQuery{
+		DBName:     db, // a label
+		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+		Iterations: 1,
+		Queries: []Query{
+			{SQL: "select pg_sleep(1)", Timeouts: Timeouts{StatementTimeout: 100 * time.Millisecond}},
+			{SQL: "select pg_sleep(1)", Timeouts: Timeouts{Timeout: 100 * time.Millisecond}},
+			{SQL: "select current_setting('statement_timeout')"},
+		},
+	}
+
+	errChan := make(chan error)
+	resultChan := make(chan QueryResult)
+	ctx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(2*time.Second),
+	)
+	defer cancel()
+
+	go func() {
+		dbq.Query(ctx, "test", errChan, resultChan)
+		close(resultChan)
+	}()
+
+	results := []QueryResult{}
+	for r := range resultChan {
+		t.Logf("result %s\n", r)
+		results = append(results, r)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if !results[0].Timeout || results[0].SQLState != "57014" {
+		t.Errorf("expected statement timeout, got %+v", results[0])
+	}
+	if !results[1].Timeout || results[1].Duration > 500*time.Millisecond {
+		t.Errorf("expected client timeout, got %+v", results[1])
+	}
+	if results[2].Err != nil || results[2].Timeout {
+		t.Errorf("expected success after reconnecting, got %+v", results[2])
+	}
+}
+
+// TestDBQuerySession tests connection settings and setup statements
+func TestDBQuerySession(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbq := DBQuery{
+		DBName:     db, // a label
+		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+		Iterations: 1,
+		Queries: []Query{
+			{SQL: "select current_setting('work_mem') = '64MB' or 1/0 = 1"},
+			{SQL: "insert into scratch values (1)"},
+		},
+		Session: SessionConfig{
+			Settings: map[string]string{"work_mem": "64MB"},
+			Setup:    []string{"create temp table scratch (id int)"},
+			Teardown: []string{"drop table scratch"},
+		},
+	}
+
+	errChan := make(chan error)
+	resultChan := make(chan QueryResult)
+	ctx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(1*time.Second),
+	)
+	defer cancel()
+
+	go func() {
+		dbq.Query(ctx, "test", errChan, resultChan)
+		close(resultChan)
+	}()
+
+	results := []QueryResult{}
+	for r := range resultChan {
+		t.Logf("result %s\n", r)
+		results = append(results, r)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("unexpected error %s", r.Err)
+		}
+	}
+
+	// a failing setup statement is reported as a setup error, classed by
+	// its sqlstate
+	dbq.Session = SessionConfig{Setup: []string{"selec 1"}}
+	resultChan = make(chan QueryResult)
+	go func() {
+		dbq.Query(ctx, "test", errChan, resultChan)
+		close(resultChan)
+	}()
+	results = []QueryResult{}
+	for r := range resultChan {
+		t.Logf("result %s\n", r)
+		results = append(results, r)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 setup result, got %d", len(results))
+	}
+	if r := results[0]; !isSetupError(r.Err) || r.SQLState != "42601" || r.ErrorClass() != classSyntax {
+		t.Errorf("unexpected setup result %+v class %s", r, r.ErrorClass())
+	}
+}
+
+// TestDBQueryProtocols tests running queries in each protocol mode
+func TestDBQueryProtocols(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	for protocol := range protocols {
+		dbq := DBQuery{
+			DBName:     db, // a label
+			DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+			Iterations: 2,
+			Queries: []Query{
+				{SQL: "select 1"},
+				{SQL: "select $1::int", Params: []Generator{&sequenceGenerator{next: 1, step: 1}}},
+				{SQL: "select generate_series(1, 10)", Fetch: true},
+			},
+			Protocol: protocol,
+		}
+
+		errChan := make(chan error)
+		resultChan := make(chan QueryResult)
+		ctx, cancel := context.WithDeadline(
+			context.Background(),
+			time.Now().Add(1*time.Second),
+		)
+
+		go func() {
+			dbq.Query(ctx, "test", errChan, resultChan)
+			close(resultChan)
+		}()
+
+		results := 0
+		for r := range resultChan {
+			results++
+			if r.Err != nil || r.Protocol != protocol {
+				t.Errorf("%s: unexpected result %+v", protocol, r)
+			}
+		}
+		cancel()
+		if results != 6 {
+			t.Errorf("%s: expected 6 results, got %d", protocol, results)
+		}
+	}
+}
+
+// TestMonitor tests sampling the server activity of a database while
+// it runs queries
+func TestMonitor(t *testing.T) {
+
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbq := DBQuery{
+		DBName:     db, // a label
+		DBURL:      fmt.Sprintf("postgres://%s:%s@%s:%v/%s", user, pass, host, port, db),
+		Iterations: 5,
+		Queries: []Query{
+			{SQL: "select * from pg_sleep(0.2)"},
+		},
+	}
+
+	m := NewMonitor()
+	m.Add("test", dbq)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		m.Run(stop, 100*time.Millisecond)
+		close(done)
+	}()
+
+	errChan := make(chan error)
+	resultChan := make(chan QueryResult)
+	go func() {
+		dbq.Query(context.Background(), "test", errChan, resultChan)
+		close(resultChan)
+	}()
+	for r := range resultChan {
+		if r.Err != nil {
+			t.Errorf("unexpected error %s", r.Err)
+		}
+	}
+	close(stop)
+	<-done
+
+	s := m.totals["test"]
+	if s == nil || s.Samples < 5 {
+		t.Fatalf("expected at least 5 samples, got %+v", s)
+	}
+	if s.Sessions["active"] == 0 || s.Waits["Timeout:PgSleep"] == 0 {
+		t.Errorf("expected active sessions sleeping: %s", s)
+	}
+	if s.Database.Commits < 5 {
+		t.Errorf("expected at least 5 commits: %s", s)
+	}
+	t.Log(s)
+}
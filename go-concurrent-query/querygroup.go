@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 )
 
 // Querier is an interface for DBQuery.Query, to allow for testing
 type Querier interface {
-	Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string)
+	Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult)
 }
 
 // DBQueryGroup represents all the information needed for a query group
@@ -15,10 +17,32 @@ type DBQueryGroup struct {
 	Name        string
 	Concurrency int
 	DBQueries   []Querier
-	errorChan   chan error    // queryChan errors
-	resultChan  chan string   // queryChan results
-	done        chan struct{} // signal the querygroup queries as complete
+	errorChan   chan error       // queryChan errors, closed on completion
+	resultChan  chan QueryResult // queryChan results, closed on completion
+	done        chan struct{}    // closed when the querygroup is complete
 	dontCycle   bool
+	profile     Profile    // optional load profile
+	rate        Rate       // initial rate for the load profile
+	scheduler   *Scheduler // rate scheduler adjusted by the load profile
+	mu          sync.Mutex
+	summary     GroupSummary
+}
+
+// GroupSummary summarises the run of a query group
+type GroupSummary struct {
+	Name      string
+	Runs      int           // number of database query runs completed
+	Cancelled bool          // the run was ended by its context
+	Duration  time.Duration // time from the start to the completion of the run
+}
+
+// String returns a string representation of a GroupSummary
+func (s GroupSummary) String() string {
+	msg := fmt.Sprintf("%d database runs in %s", s.Runs, s.Duration.Round(time.Millisecond))
+	if s.Cancelled {
+		msg += " (cancelled)"
+	}
+	return msg
 }
 
 // NewDBQueryGroup returns a new DBQueryGroup
@@ -29,61 +53,142 @@ func NewDBQueryGroup(name string, concurrency int, dontCycle bool) *DBQueryGroup
 		dontCycle:   dontCycle,
 	}
 	dbqg.errorChan = make(chan error)
-	dbqg.resultChan = make(chan string)
+	dbqg.resultChan = make(chan QueryResult)
 	dbqg.done = make(chan struct{})
+	dbqg.summary.Name = name
 	return &dbqg
 }
 
+// SetProfile sets a load profile for the group, which adjusts the
+// number of workers and the rate of the scheduler from the initial
+// concurrency and rate over time
+func (dbqg *DBQueryGroup) SetProfile(profile Profile, rate Rate, scheduler *Scheduler) {
+	dbqg.profile = profile
+	dbqg.rate = rate
+	dbqg.scheduler = scheduler
+}
+
 // AddQuerier adds a query
 func (dbqg *DBQueryGroup) AddQuerier(q Querier) {
 	dbqg.DBQueries = append(dbqg.DBQueries, q)
 }
 
+// Wait waits for the group to complete, returning a summary of its run
+func (dbqg *DBQueryGroup) Wait() GroupSummary {
+	<-dbqg.done
+	dbqg.mu.Lock()
+	defer dbqg.mu.Unlock()
+	return dbqg.summary
+}
+
 // Process the queries in the group, controlled by a context and
-// printing goroutine errors on errorChan
+// reporting goroutine errors on errorChan. Process returns when the
+// group is complete, which is when each database has been processed in
+// dontCycle mode, or otherwise when the context is done, and the
+// running queries have returned. errorChan and resultChan are then
+// closed, followed by done.
 func (dbqg *DBQueryGroup) Process(ctx context.Context) {
 
+	start := time.Now()
+	defer func() {
+		dbqg.mu.Lock()
+		dbqg.summary.Duration = time.Since(start)
+		dbqg.summary.Cancelled = ctx.Err() != nil
+		dbqg.mu.Unlock()
+		close(dbqg.errorChan)
+		close(dbqg.resultChan)
+		close(dbqg.done)
+	}()
+
 	if len(dbqg.DBQueries) < 1 {
 		dbqg.errorChan <- fmt.Errorf("no queries to run in querygroup %s", dbqg.Name)
-		dbqg.done <- struct{}{}
 		return
 	}
 
-	// producer: if dontCycle is true simply iterate over the dbqueries and
-	// push them onto the query channel (to be processed by the block above),
-	// otherwise continously push database queries onto the query channel
-	runQueries := func() <-chan Querier {
-		rq := make(chan Querier)
-		go func() {
-			if dbqg.dontCycle {
-				for _, q := range dbqg.DBQueries {
-					rq <- q
-				}
-				close(rq)
-				// dbqg.done <- struct{}{}
-			} else {
-				for counter := 0; ; counter++ {
-					i := counter % len(dbqg.DBQueries)
-					rq <- dbqg.DBQueries[i]
-				}
+	// producer: a single producer feeds the work queue shared by the
+	// consumers. If dontCycle is true each database is queued once,
+	// otherwise the databases are queued in turn until the context is
+	// done. queued is closed when the producer finishes.
+	queue := make(chan Querier)
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		defer close(queue)
+		for counter := 0; !dbqg.dontCycle || counter < len(dbqg.DBQueries); counter++ {
+			select {
+			case <-ctx.Done():
+				return
+			case queue <- dbqg.DBQueries[counter%len(dbqg.DBQueries)]:
 			}
-		}()
-		return rq
-	}
+		}
+	}()
 
-	// consumer: launch consumer goroutines for processing queries
-	for i := 1; i <= dbqg.Concurrency; i++ {
-		go func() {
-			for d := range runQueries() {
+	// consumer: a consumer goroutine for processing queries from the
+	// queue until it is closed or the context is done, which retires
+	// after its current query when stop is closed
+	var running sync.WaitGroup
+	consumer := func(stop <-chan struct{}) {
+		defer running.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case d, ok := <-queue:
+				if !ok || ctx.Err() != nil {
+					return
+				}
 				d.Query(ctx, dbqg.Name, dbqg.errorChan, dbqg.resultChan)
+				dbqg.mu.Lock()
+				dbqg.summary.Runs++
+				dbqg.mu.Unlock()
 			}
-			dbqg.done <- struct{}{}
-			return
-		}()
+		}
 	}
 
-	// close(dbqg.errorChan)
-	// close(dbqg.resultChan)
-	// close(dbqg.done)
-	return
+	// setConsumers launches or retires consumers to reach n
+	consumers := []chan struct{}{}
+	setConsumers := func(n int) {
+		for len(consumers) < n {
+			stop := make(chan struct{})
+			consumers = append(consumers, stop)
+			running.Add(1)
+			go consumer(stop)
+		}
+		for len(consumers) > n {
+			close(consumers[len(consumers)-1])
+			consumers = consumers[:len(consumers)-1]
+		}
+	}
+
+	if dbqg.profile == nil {
+		setConsumers(dbqg.Concurrency)
+	} else {
+		dbqg.followProfile(ctx, queued, setConsumers)
+	}
+	running.Wait()
+}
+
+// followProfile adjusts the number of consumers and the scheduler rate
+// to follow the load profile until the context is done or the work
+// queue is finished
+func (dbqg *DBQueryGroup) followProfile(ctx context.Context, queued <-chan struct{}, setConsumers func(int)) {
+	start := time.Now()
+	ticker := time.NewTicker(profileTick)
+	defer ticker.Stop()
+	for {
+		concurrency, rate := dbqg.profile.At(time.Since(start), dbqg.Concurrency, dbqg.rate)
+		setConsumers(concurrency)
+		if dbqg.scheduler != nil {
+			dbqg.scheduler.SetRate(rate)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-queued:
+			return
+		case <-ticker.C:
+		}
+	}
 }
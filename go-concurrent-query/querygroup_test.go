@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 )
@@ -10,22 +11,22 @@ import (
 // QueryMock mocks DBQuery.Query
 type QueryMock struct{}
 
-func (q QueryMock) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string) {
+func (q QueryMock) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
 	return
 }
 
 // QueryMockReturn mocks DBQuery.Query
 type QueryMockReturn struct{}
 
-func (q QueryMockReturn) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string) {
-	resultChan <- "result"
+func (q QueryMockReturn) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
+	resultChan <- QueryResult{Group: label}
 	return
 }
 
 // QueryMockSlow mocks DBQuery.Query
 type QueryMockSlow struct{}
 
-func (q QueryMockSlow) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string) {
+func (q QueryMockSlow) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
 	time.Sleep(10 * time.Millisecond)
 	return
 }
@@ -33,7 +34,7 @@ func (q QueryMockSlow) Query(ctx context.Context, label string, errorChan chan<-
 // QueryMockError mocks DBQuery.Query
 type QueryMockError struct{}
 
-func (q QueryMockError) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- string) {
+func (q QueryMockError) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
 	errorChan <- errors.New("mock error")
 	return
 }
@@ -113,6 +114,34 @@ LOOP:
 	}
 }
 
+// drain reads a query group's errors and results until its channels
+// are closed on completion, failing the test if this takes longer than
+// timeout
+func drain(t *testing.T, qg *DBQueryGroup, timeout time.Duration) (errs, results int) {
+	t.Helper()
+	errorChan, resultChan := qg.errorChan, qg.resultChan
+	expired := time.After(timeout)
+	for errorChan != nil || resultChan != nil {
+		select {
+		case _, ok := <-errorChan:
+			if !ok {
+				errorChan = nil
+				continue
+			}
+			errs++
+		case _, ok := <-resultChan:
+			if !ok {
+				resultChan = nil
+				continue
+			}
+			results++
+		case <-expired:
+			t.Fatal("hit timeout, query group channels should be closed")
+		}
+	}
+	return errs, results
+}
+
 // Test with timeout
 func TestQueryGroupTimout(t *testing.T) {
 	ctx, cancel := context.WithDeadline(
@@ -126,66 +155,83 @@ func TestQueryGroupTimout(t *testing.T) {
 	qg.AddQuerier(QueryMockSlow{})
 	go qg.Process(ctx)
 
-	timeout := make(chan struct{})
-	go func() {
-		time.Sleep(20 * time.Millisecond)
-		timeout <- struct{}{}
-	}()
-
-LOOP:
-	for {
-		select {
-		case <-qg.errorChan:
-			t.Errorf("hit errorchan, should hit errorchan")
-			break LOOP
-		case <-qg.resultChan:
-			t.Errorf("hit resultchan, should hit errorchan")
-			break LOOP
-		case <-qg.done:
-			t.Errorf("hit done, should hit errorchan")
-			break LOOP
-		case <-ctx.Done():
-			cancel()
-			break LOOP
-		case <-timeout:
-			t.Errorf("hit timeout, should hit errorchan")
-			break LOOP
-		}
+	errs, results := drain(t, qg, 100*time.Millisecond)
+	if errs != 0 || results != 0 {
+		t.Errorf("errors %d and results %d should be 0", errs, results)
+	}
+	if s := qg.Wait(); !s.Cancelled || s.Runs < 1 {
+		t.Errorf("unexpected summary %+v", s)
 	}
 }
 
-// Test cycling : no cycling
-func TestQueryGroupNoCycle(t *testing.T) {
-	ctx := context.Background()
-	counter := 0
+// QueryMockCount mocks DBQuery.Query, counting its calls
+type QueryMockCount struct {
+	mu    *sync.Mutex
+	calls *int
+}
 
-	qg := NewDBQueryGroup("test2", 1, true)
-	qg.AddQuerier(QueryMockReturn{})
-	qg.AddQuerier(QueryMockReturn{})
-	go qg.Process(ctx)
+func (q QueryMockCount) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
+	q.mu.Lock()
+	*q.calls++
+	q.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	resultChan <- QueryResult{Group: label}
+}
 
-	timeout := time.After(200 * time.Millisecond)
+// Test cycling : no cycling, with each database processed exactly once
+// whatever the concurrency, and the group completing without a cancel
+func TestQueryGroupNoCycle(t *testing.T) {
+	for _, concurrency := range []int{1, 2, 3, 8} {
+		var mu sync.Mutex
+		calls := make([]int, 3)
 
-LOOP:
-	for {
-		select {
-		case <-qg.errorChan:
-			t.Errorf("hit errorchan, should hit resultchan")
-			break LOOP
-		case <-qg.resultChan:
-			counter++
-			if counter > 1 {
-				break LOOP
+		qg := NewDBQueryGroup("test2", concurrency, true)
+		for i := range calls {
+			qg.AddQuerier(QueryMockCount{&mu, &calls[i]})
+		}
+		go qg.Process(context.Background())
+
+		errs, results := drain(t, qg, 200*time.Millisecond)
+		if errs != 0 || results != 3 {
+			t.Errorf("concurrency %d: errors %d should be 0 and results %d should be 3", concurrency, errs, results)
+		}
+		mu.Lock()
+		for i, c := range calls {
+			if c != 1 {
+				t.Errorf("concurrency %d: database %d processed %d times, should be once", concurrency, i, c)
 			}
-		case <-qg.done:
-			break LOOP
-		case <-timeout:
-			t.Errorf("hit timeout, should hit resultchan")
-			break LOOP
+		}
+		mu.Unlock()
+		if s := qg.Wait(); s.Runs != 3 || s.Cancelled {
+			t.Errorf("concurrency %d: unexpected summary %+v", concurrency, s)
 		}
 	}
-	if counter != 2 {
-		t.Errorf("counter %d should be 2", counter)
+}
+
+// Test no cycling with a load profile, which completes once each
+// database is processed
+func TestQueryGroupNoCycleProfile(t *testing.T) {
+	defer func(tick time.Duration) { profileTick = tick }(profileTick)
+	profileTick = time.Millisecond
+
+	var mu sync.Mutex
+	calls := make([]int, 5)
+	qg := NewDBQueryGroup("test3", 1, true)
+	qg.SetProfile(Profile{{Duration: time.Hour, Concurrency: 3, Ramp: "linear"}}, 0, nil)
+	for i := range calls {
+		qg.AddQuerier(QueryMockCount{&mu, &calls[i]})
+	}
+	go qg.Process(context.Background())
+
+	if _, results := drain(t, qg, 200*time.Millisecond); results != 5 {
+		t.Errorf("results %d should be 5", results)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, c := range calls {
+		if c != 1 {
+			t.Errorf("database %d processed %d times, should be once", i, c)
+		}
 	}
 }
 
@@ -196,31 +242,21 @@ func TestQueryGroupCycle(t *testing.T) {
 		time.Now().Add(2*time.Millisecond),
 	)
 	defer cancel()
-	counter := 0
 
 	qg := NewDBQueryGroup("test4", 4, false)
 	qg.AddQuerier(QueryMockReturn{})
 	qg.AddQuerier(QueryMockReturn{})
 	go qg.Process(ctx)
 
-LOOP:
-	for {
-		select {
-		case <-qg.errorChan:
-			t.Errorf("hit errorchan, should hit ctx.Done")
-			break LOOP
-		case <-qg.resultChan:
-			counter++ // falls through to qg.done
-		case <-qg.done:
-			t.Errorf("hit done, should hit ctx.Done")
-			break LOOP
-		case <-ctx.Done():
-			cancel()
-			break LOOP
-		}
+	errs, results := drain(t, qg, 100*time.Millisecond)
+	if errs != 0 {
+		t.Errorf("errors %d should be 0", errs)
 	}
-	if counter < 20 {
-		t.Errorf("counter %d should be >20", counter)
+	if results < 20 {
+		t.Errorf("results %d should be >20", results)
+	}
+	if s := qg.Wait(); s.Runs != results || !s.Cancelled {
+		t.Errorf("unexpected summary %+v for %d results", s, results)
 	}
 }
 
@@ -238,29 +274,110 @@ func TestQueryGroupWithCancel(t *testing.T) {
 		cancel()
 	}()
 
-	timeout := make(chan struct{})
+	errs, results := drain(t, qg, 100*time.Millisecond)
+	if errs != 0 || results != 0 {
+		t.Errorf("errors %d and results %d should be 0", errs, results)
+	}
+	select {
+	case <-qg.done:
+	default:
+		t.Error("done should be closed")
+	}
+}
+
+// QueryMockConcurrent mocks DBQuery.Query, recording the maximum number
+// of concurrent queries
+type QueryMockConcurrent struct {
+	mu      *sync.Mutex
+	current *int
+	max     *int
+}
+
+func (q QueryMockConcurrent) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
+	q.mu.Lock()
+	*q.current++
+	if *q.current > *q.max {
+		*q.max = *q.current
+	}
+	q.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+	q.mu.Lock()
+	*q.current--
+	q.mu.Unlock()
+}
+
+// Test a load profile stepping up concurrency
+func TestQueryGroupProfile(t *testing.T) {
+	defer func(tick time.Duration) { profileTick = tick }(profileTick)
+	profileTick = time.Millisecond
+	ctx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now().Add(60*time.Millisecond),
+	)
+	defer cancel()
+
+	var mu sync.Mutex
+	current, max := 0, 0
+	qg := NewDBQueryGroup("test5", 1, false)
+	qg.SetProfile(
+		Profile{
+			{Duration: 20 * time.Millisecond},
+			{Duration: time.Second, Concurrency: 4},
+		},
+		0, nil,
+	)
+	qg.AddQuerier(QueryMockConcurrent{&mu, &current, &max})
+
+	go qg.Process(ctx)
+	<-ctx.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 4 {
+		t.Errorf("max concurrency %d should be 4", max)
+	}
+}
+
+// QueryMockCancel mocks DBQuery.Query, blocking until the context is
+// done and counting the queries started after it is done
+type QueryMockCancel struct {
+	mu    *sync.Mutex
+	after *int
+}
+
+func (q QueryMockCancel) Query(ctx context.Context, label string, errorChan chan<- error, resultChan chan<- QueryResult) {
+	if ctx.Err() != nil {
+		q.mu.Lock()
+		*q.after++
+		q.mu.Unlock()
+	}
+	<-ctx.Done()
+	resultChan <- QueryResult{Group: label, Err: ctx.Err()}
+}
+
+// Test that the group completes once running queries return after a
+// cancel, and that no queries start after the cancel
+func TestQueryGroupCancelRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu sync.Mutex
+	after := 0
+	qg := NewDBQueryGroup("test6", 3, false)
+	qg.AddQuerier(QueryMockCancel{&mu, &after})
+	go qg.Process(ctx)
+
 	go func() {
-		time.Sleep(20 * time.Millisecond)
-		timeout <- struct{}{}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
 	}()
 
-LOOP:
-	for {
-		select {
-		case <-qg.errorChan:
-			t.Errorf("hit ctx.done, should hit ctx.done")
-			break LOOP
-		case <-qg.resultChan:
-			t.Errorf("hit resultchan, should hit ctx.done")
-			break LOOP
-		case <-qg.done:
-			t.Errorf("hit done, should hit ctx.done")
-			break LOOP
-		case <-timeout:
-			t.Errorf("hit timeout, should hit ctx.done")
-			break LOOP
-		case <-ctx.Done():
-			break LOOP
-		}
+	errs, results := drain(t, qg, 200*time.Millisecond)
+	if errs != 0 || results != 3 {
+		t.Errorf("errors %d should be 0 and results %d should be 3, one for each running query", errs, results)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if after != 0 {
+		t.Errorf("%d queries started after cancel", after)
 	}
 }
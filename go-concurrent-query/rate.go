@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Rate is a target rate of queries per second, set in yaml as a number
+// with an optional unit, eg "200/s", "600/m" or "1000/h"
+type Rate float64
+
+// UnmarshalYAML parses a rate from a yaml scalar
+func (r *Rate) UnmarshalYAML(value *yaml.Node) error {
+	rate, err := parseRate(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// parseRate parses a rate string
+func parseRate(s string) (Rate, error) {
+	num, unit := s, "s"
+	if i := strings.Index(s, "/"); i >= 0 {
+		num, unit = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	switch unit {
+	case "s":
+	case "m":
+		f = f / 60
+	case "h":
+		f = f / 3600
+	default:
+		return 0, fmt.Errorf("invalid rate unit in %q, use s, m or h", s)
+	}
+	return Rate(f), nil
+}
+
+// Scheduler issues query start times at a fixed rate, for open-loop
+// load testing. Start times are claimed in turn by the workers of a
+// query group regardless of whether earlier queries have completed, so
+// when the workers cannot keep up with the rate the scheduled start
+// times fall behind the actual start times, making coordinated omission
+// visible. A Scheduler with a zero rate, or a nil Scheduler, does not
+// limit the rate. It is safe for concurrent use.
+type Scheduler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// NewScheduler returns a Scheduler for the rate
+func NewScheduler(rate Rate) *Scheduler {
+	s := &Scheduler{}
+	s.SetRate(rate)
+	return s
+}
+
+// SetRate changes the rate of the Scheduler
+func (s *Scheduler) SetRate(rate Rate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rate <= 0 {
+		s.interval = 0
+		return
+	}
+	if s.interval == 0 {
+		// restart the schedule after an unlimited period
+		s.next = time.Time{}
+	}
+	s.interval = time.Duration(float64(time.Second) / float64(rate))
+}
+
+// Wait claims the next scheduled start time and waits until it arrives
+// or the context is cancelled, returning the scheduled time, which is
+// zero if the rate is not limited
+func (s *Scheduler) Wait(ctx context.Context) (time.Time, error) {
+	if s == nil {
+		return time.Time{}, ctx.Err()
+	}
+
+	s.mu.Lock()
+	if s.interval == 0 {
+		s.mu.Unlock()
+		return time.Time{}, ctx.Err()
+	}
+	now := time.Now()
+	if s.next.IsZero() {
+		s.next = now
+	}
+	scheduled := s.next
+	s.next = s.next.Add(s.interval)
+	s.mu.Unlock()
+
+	wait := scheduled.Sub(now)
+	if wait <= 0 {
+		return scheduled, ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return scheduled, nil
+	case <-ctx.Done():
+		return scheduled, ctx.Err()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestParseRate(t *testing.T) {
+	for i, test := range []struct {
+		rate   string
+		expect Rate
+		errors bool
+	}{
+		{rate: "200/s", expect: 200},
+		{rate: "200", expect: 200},
+		{rate: "120 / m", expect: 2},
+		{rate: "7200/h", expect: 2},
+		{rate: "0.5/s", expect: 0.5},
+		{rate: "x/s", errors: true},
+		{rate: "-1/s", errors: true},
+		{rate: "10/d", errors: true},
+	} {
+		r, err := parseRate(test.rate)
+		if test.errors && err == nil {
+			t.Errorf("test %d should fail", i)
+		}
+		if !test.errors && err != nil {
+			t.Errorf("test %d should succeed (err %s)", i, err)
+		}
+		if r != test.expect {
+			t.Errorf("test %d rate %g should be %g", i, r, test.expect)
+		}
+	}
+}
+
+func TestRateYaml(t *testing.T) {
+	var g DBQueryGroupConfig
+	if err := yaml.Unmarshal([]byte("rate: 600/m"), &g); err != nil {
+		t.Fatal(err)
+	}
+	if g.Rate != 10 {
+		t.Errorf("rate %g should be 10", g.Rate)
+	}
+}
+
+// TestScheduler checks that scheduled times are spaced by the rate
+// interval and that waits are paced accordingly
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(200) // 5ms interval
+	ctx := context.Background()
+
+	t0 := time.Now()
+	var last time.Time
+	for i := 0; i < 5; i++ {
+		scheduled, err := s.Wait(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && scheduled.Sub(last) != 5*time.Millisecond {
+			t.Errorf("schedule interval %s should be 5ms", scheduled.Sub(last))
+		}
+		last = scheduled
+	}
+	if elapsed := time.Since(t0); elapsed < 20*time.Millisecond {
+		t.Errorf("elapsed %s should be at least 20ms", elapsed)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := NewScheduler(1) // 1s interval
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.Wait(ctx); err != nil {
+		t.Errorf("first wait should not fail: %s", err)
+	}
+	if _, err := s.Wait(ctx); err == nil {
+		t.Error("second wait should be cancelled")
+	}
+}
+
+func TestSchedulerUnlimited(t *testing.T) {
+	for _, s := range []*Scheduler{nil, NewScheduler(0)} {
+		scheduled, err := s.Wait(context.Background())
+		if err != nil || !scheduled.IsZero() {
+			t.Errorf("unlimited scheduler should return zero time, got %s %v", scheduled, err)
+		}
+	}
+}
+
+func TestSchedulerSetRate(t *testing.T) {
+	s := NewScheduler(0)
+	s.SetRate(100)
+	ctx := context.Background()
+	first, _ := s.Wait(ctx)
+	second, _ := s.Wait(ctx)
+	if second.Sub(first) != 10*time.Millisecond {
+		t.Errorf("schedule interval %s should be 10ms", second.Sub(first))
+	}
+	s.SetRate(0)
+	if scheduled, _ := s.Wait(ctx); !scheduled.IsZero() {
+		t.Error("scheduler should not limit after rate set to 0")
+	}
+}
+
+func TestQueryResultLag(t *testing.T) {
+	now := time.Now()
+	r := QueryResult{Start: now, Scheduled: now.Add(-3 * time.Millisecond)}
+	if r.Lag() != 3*time.Millisecond {
+		t.Errorf("lag %s should be 3ms", r.Lag())
+	}
+	if (QueryResult{Start: now}).Lag() != 0 {
+		t.Error("unscheduled result should have no lag")
+	}
+}
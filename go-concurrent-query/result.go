@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// QueryResult describes the outcome of a single query execution, or of
+// a failed attempt to connect to a database or to set up its session,
+// in which case Query is empty and QueryIndex is -1
+type QueryResult struct {
+	Group      string        // query group label
+	Database   string        // database name
+	Iteration  int           // iteration number, from 1
+	QueryIndex int           // index of the query in the query list
+	Query      string        // query text
+	QueryName  string        // optional query name
+	Start      time.Time     // query start time
+	Scheduled  time.Time     // scheduled start time for rate limited queries
+	Duration   time.Duration // query duration
+	Rows       int64         // rows affected, or rows read by fetch queries
+	Bytes      int64         // approximate bytes read by fetch queries
+	FirstRow   time.Duration // time to the first row of fetch queries
+	Err        error         // query or connection error
+	SQLState   string        // SQLSTATE code of a postgresql error
+	TLS        string        // negotiated tls version, empty if not tls
+	Timeout    bool          // the query exceeded its client or statement timeout
+	Protocol   string        // protocol mode, empty for the pgx default
+
+	// transactions and their statements
+	Transaction string // transaction name
+	Statement   int    // statement number from 1, or 0 for the transaction
+	Retries     int    // transaction retries
+}
+
+// IsTransaction reports whether the result is for a transaction
+func (r QueryResult) IsTransaction() bool {
+	return r.Transaction != "" && r.Statement == 0
+}
+
+// IsStatement reports whether the result is for a statement in a
+// transaction
+func (r QueryResult) IsStatement() bool {
+	return r.Transaction != "" && r.Statement > 0
+}
+
+// QueryLabel returns the query name, or the query text if the query
+// is not named, prefixed by the transaction name for transactions and
+// their statements
+func (r QueryResult) QueryLabel() string {
+	label := r.QueryName
+	if label == "" {
+		label = r.Query
+	}
+	switch {
+	case r.IsTransaction():
+		return "tx:" + r.Transaction
+	case r.IsStatement():
+		return fmt.Sprintf("tx:%s:%d:%s", r.Transaction, r.Statement, label)
+	}
+	return label
+}
+
+// Lag returns the delay between the scheduled and actual start of a
+// rate limited query
+func (r QueryResult) Lag() time.Duration {
+	if r.Scheduled.IsZero() || r.Start.Before(r.Scheduled) {
+		return 0
+	}
+	return r.Start.Sub(r.Scheduled)
+}
+
+// sqlState returns the SQLSTATE code of a postgresql error, or an
+// empty string for other errors
+func sqlState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// String renders the result as a log line
+func (r QueryResult) String() string {
+	switch {
+	case r.Err != nil && r.QueryIndex < 0 && isSetupError(r.Err):
+		return fmt.Sprintf("error setting up session on %s : %s", r.Database, r.Err)
+	case r.Err != nil && r.QueryIndex < 0:
+		return fmt.Sprintf("error connecting to %s : %s", r.Database, r.Err)
+	case r.Timeout && r.IsTransaction():
+		return fmt.Sprintf("timeout on %s in transaction %s: %s", r.Database, r.Transaction, r.Err)
+	case r.Timeout:
+		return fmt.Sprintf("timeout on %s executing %s: %s", r.Database, r.Query, r.Err)
+	case r.Err != nil && r.IsTransaction():
+		return fmt.Sprintf("error on %s in transaction %s: %s", r.Database, r.Transaction, r.Err)
+	case r.Err != nil:
+		return fmt.Sprintf("error on %s executing %s: %s", r.Database, r.Query, r.Err)
+	case r.IsTransaction():
+		return fmt.Sprintf(
+			"[%-20s:%02d] %0.3fs transaction %s (%d retries)",
+			r.Group+":"+r.Database, r.Iteration, r.Duration.Seconds(), r.Transaction, r.Retries,
+		)
+	}
+	return fmt.Sprintf(
+		"[%-20s:%02d] %0.3fs %s",
+		r.Group+":"+r.Database, r.Iteration, r.Duration.Seconds(), r.Query,
+	)
+}
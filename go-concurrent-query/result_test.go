@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestQueryResultString(t *testing.T) {
+
+	for i, test := range []struct {
+		result QueryResult
+		expect string
+	}{
+		{
+			result: QueryResult{
+				Group: "g1", Database: "db1", Iteration: 2, Query: "select 1",
+				Duration: 1500 * time.Millisecond,
+			},
+			expect: "[g1:db1              :02] 1.500s select 1",
+		},
+		{
+			result: QueryResult{
+				Group: "g1", Database: "db1", Iteration: 1, Query: "select x",
+				Err: errors.New("failed"),
+			},
+			expect: "error on db1 executing select x: failed",
+		},
+		{
+			result: QueryResult{
+				Group: "g1", Database: "db1", QueryIndex: -1,
+				Err: errors.New("refused"),
+			},
+			expect: "error connecting to db1 : refused",
+		},
+		{
+			result: QueryResult{
+				Group: "g1", Database: "db1", QueryIndex: -1,
+				Err: &SetupError{errors.New(`session setup "set x": syntax error`)},
+			},
+			expect: `error setting up session on db1 : session setup "set x": syntax error`,
+		},
+		{
+			result: QueryResult{
+				Group: "g1", Database: "db1", Iteration: 1, Query: "select pg_sleep(10)",
+				Err: errors.New("timeout: context deadline exceeded"), Timeout: true,
+			},
+			expect: "timeout on db1 executing select pg_sleep(10): timeout: context deadline exceeded",
+		},
+	} {
+		if got := test.result.String(); got != test.expect {
+			t.Errorf("test %d got %q expected %q", i, got, test.expect)
+		}
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "42P01"})
+	if s := sqlState(err); s != "42P01" {
+		t.Errorf("sqlstate %q should be 42P01", s)
+	}
+	if s := sqlState(errors.New("other")); s != "" {
+		t.Errorf("sqlstate %q should be empty", s)
+	}
+}
+
+func TestQueryResultLabel(t *testing.T) {
+	for i, test := range []struct {
+		result QueryResult
+		expect string
+	}{
+		{result: QueryResult{Query: "select 1"}, expect: "select 1"},
+		{result: QueryResult{Query: "select 1", QueryName: "one"}, expect: "one"},
+		{result: QueryResult{Query: "update x", Transaction: "t1"}, expect: "tx:t1"},
+		{result: QueryResult{Query: "update x", Transaction: "t1", Statement: 2}, expect: "tx:t1:2:update x"},
+	} {
+		if got := test.result.QueryLabel(); got != test.expect {
+			t.Errorf("test %d got %q expected %q", i, got, test.expect)
+		}
+	}
+}
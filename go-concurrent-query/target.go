@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/rorycl/pgtools/pgconnect"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TargetConfig sets out the connection settings for a database server.
+// Unset settings are taken from the command line connection options.
+type TargetConfig struct {
+	Host               string // host, or comma separated hosts
+	Port               string // port, or comma separated ports for each host
+	User               string
+	Password           string
+	Passfile           string
+	SSLMode            string            `yaml:"sslmode"`
+	ApplicationName    string            `yaml:"application_name"`
+	TargetSessionAttrs string            `yaml:"target_session_attrs"`
+	SSLRootCert        string            `yaml:"sslrootcert"`
+	SSLCert            string            `yaml:"sslcert"`
+	SSLKey             string            `yaml:"sslkey"`
+	SSLPassword        string            `yaml:"sslpassword"`
+	Params             map[string]string // other connection parameters
+}
+
+// DatabaseConfig is a database in a query group and the name of the
+// target server it is on. A database on the group's default target may
+// be given in yaml as a string.
+type DatabaseConfig struct {
+	Name   string
+	Target string
+}
+
+// UnmarshalYAML decodes a database from a yaml string or mapping
+func (d *DatabaseConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		d.Name = value.Value
+		return nil
+	}
+	type plain DatabaseConfig // avoid recursion
+	return value.Decode((*plain)(d))
+}
+
+// Label returns the database name, qualified by the target name if
+// set, to distinguish databases of the same name on different servers
+func (d DatabaseConfig) Label() string {
+	if d.Target == "" {
+		return d.Name
+	}
+	return d.Name + "@" + d.Target
+}
+
+// settings returns the connection settings for the target, with unset
+// settings taken from defaults. A target password or passfile replaces
+// both of the defaults, and a target client certificate or key replaces
+// the default certificate, key and key password.
+func (t TargetConfig) settings(defaults pgconnect.Settings) (pgconnect.Settings, error) {
+	s := defaults.Copy()
+	if t.Password != "" || t.Passfile != "" {
+		delete(s, "password")
+		delete(s, "passfile")
+	}
+	if t.SSLCert != "" || t.SSLKey != "" {
+		delete(s, "sslcert")
+		delete(s, "sslkey")
+		delete(s, "sslpassword")
+	}
+	for k, v := range t.Params {
+		s.Set(k, v)
+	}
+	s.Set("host", t.Host)
+	s.Set("port", t.Port)
+	s.Set("user", t.User)
+	s.Set("password", t.Password)
+	s.Set("passfile", t.Passfile)
+	s.Set("sslmode", t.SSLMode)
+	s.Set("application_name", t.ApplicationName)
+	s.Set("target_session_attrs", t.TargetSessionAttrs)
+	s.Set("sslrootcert", t.SSLRootCert)
+	s.Set("sslcert", t.SSLCert)
+	s.Set("sslkey", t.SSLKey)
+	s.Set("sslpassword", t.SSLPassword)
+	return s, s.Check()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rorycl/pgtools/pgconnect"
+)
+
+func TestTargetSettings(t *testing.T) {
+
+	defaults := pgconnect.Settings{
+		"host":            "127.0.0.1",
+		"port":            "5432",
+		"user":            "user",
+		"password":        "pass",
+		"connect_timeout": "5",
+	}
+
+	for i, test := range []struct {
+		target TargetConfig
+		expect string
+	}{
+		{
+			target: TargetConfig{},
+			expect: "connect_timeout='5' dbname='db' host='127.0.0.1' password='pass' port='5432' user='user'",
+		},
+		{
+			target: TargetConfig{Host: "replica.example.com", Port: "6432", SSLMode: "require"},
+			expect: "connect_timeout='5' dbname='db' host='replica.example.com' password='pass' port='6432' sslmode='require' user='user'",
+		},
+		{
+			target: TargetConfig{Host: "::1", User: "app", Password: "p@ss 'word'"},
+			expect: `connect_timeout='5' dbname='db' host='::1' password='p@ss \'word\'' port='5432' user='app'`,
+		},
+		{
+			target: TargetConfig{Passfile: "/home/app/.pgpass", ApplicationName: "load test"},
+			expect: "application_name='load test' connect_timeout='5' dbname='db' host='127.0.0.1' passfile='/home/app/.pgpass' port='5432' user='user'",
+		},
+		{
+			target: TargetConfig{Host: "db1,[::1],/tmp", Port: "5432,5433,5434", TargetSessionAttrs: "read-write"},
+			expect: "connect_timeout='5' dbname='db' host='db1,::1,/tmp' password='pass' port='5432,5433,5434' target_session_attrs='read-write' user='user'",
+		},
+		{
+			target: TargetConfig{SSLRootCert: "/etc/ssl/ca.crt", SSLCert: "app.crt", SSLKey: "app.key"},
+			expect: "connect_timeout='5' dbname='db' host='127.0.0.1' password='pass' port='5432' sslcert='app.crt' sslkey='app.key' sslrootcert='/etc/ssl/ca.crt' user='user'",
+		},
+		{
+			target: TargetConfig{Params: map[string]string{"connect_timeout": "2"}},
+			expect: "connect_timeout='2' dbname='db' host='127.0.0.1' password='pass' port='5432' user='user'",
+		},
+	} {
+		settings, err := test.target.settings(defaults)
+		if err != nil {
+			t.Errorf("test %d unexpected error %s", i, err)
+			continue
+		}
+		got := settings.ConnString("db")
+		if got != test.expect {
+			t.Errorf("test %d got %s expected %s", i, got, test.expect)
+		}
+	}
+	if _, err := (TargetConfig{Host: "db1:5432"}).settings(defaults); err == nil {
+		t.Error("invalid target host should fail")
+	}
+	if _, ok := defaults["dbname"]; ok {
+		t.Error("defaults should not be modified")
+	}
+}
+
+func TestDatabaseLabel(t *testing.T) {
+	if l := (DatabaseConfig{Name: "db1"}).Label(); l != "db1" {
+		t.Errorf("label %s should be db1", l)
+	}
+	if l := (DatabaseConfig{Name: "db1", Target: "replica"}).Label(); l != "db1@replica" {
+		t.Errorf("label %s should be db1@replica", l)
+	}
+}
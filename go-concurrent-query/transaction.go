@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// retrySQLStates are the SQLSTATE codes of transaction failures which
+// may succeed if retried: serialization failure and deadlock detected
+var retrySQLStates = map[string]bool{
+	"40001": true,
+	"40P01": true,
+}
+
+// Transaction is a named script of statements run in a transaction
+type Transaction struct {
+	Name       string
+	Isolation  pgx.TxIsoLevel
+	Retries    int
+	Statements []Query
+}
+
+// NewTransactions makes transactions from transaction configurations,
+// with statement timeouts not set by a statement or its transaction
+// taken from defaults
+func NewTransactions(configs []TransactionConfig, defaults Timeouts) ([]Transaction, error) {
+	transactions := []Transaction{}
+	for _, c := range configs {
+		statements, err := NewQueries(c.Statements, c.Timeouts.withDefaults(defaults))
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, Transaction{
+			Name:       c.Name,
+			Isolation:  isolationLevels[strings.ToLower(c.Isolation)],
+			Retries:    c.Retries,
+			Statements: statements,
+		})
+	}
+	return transactions, nil
+}
+
+// sql returns the statements of the transaction as a single string
+func (t Transaction) sql() string {
+	statements := []string{}
+	for _, s := range t.Statements {
+		statements = append(statements, strings.TrimSpace(s.SQL))
+	}
+	return strings.Join(statements, "; ")
+}
+
+// runTransaction runs a transaction on the session connection,
+// reporting the outcome of each statement and of the transaction as a
+// whole on resultChan, and retrying the transaction on serialization
+// failures and deadlocks. False is returned if the context is done.
+func (d DBQuery) runTransaction(ctx context.Context, sess *session, label string, t Transaction, base QueryResult, resultChan chan<- QueryResult) bool {
+
+	start := time.Now()
+	var rows int64
+	var err error
+	var timeout bool
+	retries := 0
+	for ; ; retries++ {
+		var tx pgx.Tx
+		tx, err = sess.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: t.Isolation})
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			break
+		}
+		// a statement timeout set in the transaction is reverted if
+		// the transaction is rolled back
+		statementTimeout := sess.statementTimeout
+		rows = 0
+		for i, s := range t.Statements {
+			r, ok := d.exec(ctx, sess, tx, label, s)
+			if !ok {
+				cancelQuery(sess.conn.PgConn())
+				tx.Rollback(context.Background())
+				return false
+			}
+			r.Iteration, r.QueryIndex, r.TLS = base.Iteration, base.QueryIndex, base.TLS
+			r.Transaction, r.Statement = t.Name, i+1
+			resultChan <- r
+			if err, timeout = r.Err, r.Timeout; err != nil {
+				break
+			}
+			rows += r.Rows
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		} else {
+			tx.Rollback(ctx)
+		}
+		if err != nil {
+			sess.statementTimeout = statementTimeout
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if err == nil || !retrySQLStates[sqlState(err)] || retries >= t.Retries {
+			break
+		}
+	}
+
+	r := base
+	r.Query = t.sql()
+	r.QueryName = t.Name
+	r.Transaction = t.Name
+	r.Start = start
+	r.Duration = time.Since(start)
+	r.Rows = rows
+	r.Retries = retries
+	r.Err = err
+	r.SQLState = sqlState(err)
+	r.Timeout = timeout
+	r.Protocol = d.Protocol
+	resultChan <- r
+	return true
+}
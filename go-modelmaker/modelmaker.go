@@ -13,6 +13,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"html/template"
 	"log"
@@ -22,6 +23,7 @@ import (
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/pgtools/pgconnect"
 )
 
 const query = `
@@ -112,12 +114,27 @@ func (r *Result) String() (returner string) {
 	return fmt.Sprint(b.String())
 }
 
-func dbquery(url string, searchpath string, searchstring string) []*Result {
+func dbquery(settings pgconnect.Settings, database string, searchpath string, searchstring string) []*Result {
 
 	ctx := context.Background()
-	db, err := pgx.Connect(ctx, url)
+	config, err := pgx.ParseConfig(settings.ConnString(database))
 	if err != nil {
-		log.Fatalf("Connection error : %s : %v\n", url, err)
+		log.Fatalf("Connection settings error : %v\n", err)
+	}
+	cert, err := settings.Certificate()
+	if err != nil {
+		log.Fatalf("Client certificate error : %v\n", err)
+	}
+	configs := []*tls.Config{config.TLSConfig}
+	for _, f := range config.Fallbacks {
+		configs = append(configs, f.TLSConfig)
+	}
+	pgconnect.SetCertificate(cert, configs...)
+
+	db, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		// log the settings without the connection string's password
+		log.Fatalf("Connection error : %s dbname=%s : %v\n", settings, database, err)
 	}
 	_, err = db.Exec(ctx, "set search_path="+searchpath)
 	if err != nil {
@@ -133,22 +150,14 @@ func dbquery(url string, searchpath string, searchstring string) []*Result {
 
 // Options show flag options
 type Options struct {
-	User       string `short:"u" long:"user"       description:"database user" required:"true"`
-	Pass       string `short:"p" long:"password"   description:"database pass" required:"true"`
+	pgconnect.Options `group:"Connection Options"`
+
 	Database   string `short:"d" long:"database"   description:"database" required:"true"`
-	Port       int    `short:"P" long:"port"       description:"server port" default:"5432"`
-	Host       string `short:"H" long:"host"       description:"server host" default:"127.0.0.1"`
 	Searchpath string `short:"s" long:"searchpath" description:"searchpath" required:"true"`
 	Template   string `short:"t" long:"template"   description:"template file" default:"templates/python.tpl"`
 	Filter     string `short:"f" long:"filter"     description:"filter for function names (regexes allowed)"`
 }
 
-// dburl constructs a database connection url
-func (o *Options) dburl(database string) string {
-	var tpl = "postgres://%s:%s@%s:%v/%s"
-	return fmt.Sprintf(tpl, o.User, o.Pass, o.Host, o.Port, database)
-}
-
 var usage = `: introspect a postgres database's plpgsql functions`
 
 func main() {
@@ -162,8 +171,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	db := options.dburl(options.Database)
-	results := dbquery(db, options.Searchpath, options.Filter)
+	settings, err := options.Settings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	results := dbquery(settings, options.Database, options.Searchpath, options.Filter)
 
 	for _, r := range results {
 		r.Arger()
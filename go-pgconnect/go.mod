@@ -0,0 +1,3 @@
+module github.com/rorycl/pgtools/pgconnect
+
+go 1.15
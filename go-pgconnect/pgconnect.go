@@ -0,0 +1,318 @@
+/*
+Package pgconnect provides the Postgresql connection options shared by
+the pgtools programmes.
+
+Connection settings may be given as a connection string, in keyword/value
+or url form, and as individual options, which take precedence. Settings
+which are not given are left to the driver, which follows libpq in
+reading them from the PGHOST, PGPORT, PGUSER, PGPASSWORD, PGSSLMODE and
+other environment variables, from a service in pg_service.conf and, for
+passwords, from .pgpass.
+
+Rory Campbell-Lange : August 2022
+*/
+package pgconnect
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostnameRegexp matches a dns host name
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*\.?$`)
+
+// sslModes are the valid sslmode settings
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// defaultPort is the port of hosts in a multi-host url without one
+const defaultPort = "5432"
+
+// Options are the connection options for embedding in a programme's
+// command line options
+type Options struct {
+	DSN                string `long:"dsn"                  description:"connection string or url, eg \"host=db1 sslmode=require\""`
+	Host               string `short:"H" long:"host"       description:"server host name, address or socket directory, or comma separated hosts (default PGHOST or localhost)"`
+	Port               string `short:"P" long:"port"       description:"server port, or comma separated ports for each host (default PGPORT or 5432)"`
+	User               string `short:"u" long:"user"       description:"database user (default PGUSER or login name)"`
+	Pass               string `short:"p" long:"password"   description:"database pass (prefer PGPASSWORD or .pgpass)"`
+	Service            string `long:"service"              description:"service name in pg_service.conf (default PGSERVICE)"`
+	TargetSessionAttrs string `long:"target-session-attrs" description:"session type required of multiple hosts, eg read-write or any"`
+	SSLMode            string `long:"sslmode"              description:"tls mode: disable, allow, prefer, require, verify-ca or verify-full (default PGSSLMODE or prefer)"`
+	SSLRootCert        string `long:"sslrootcert"          description:"certificate authority file for verify-ca or verify-full"`
+	SSLCert            string `long:"sslcert"              description:"client certificate file"`
+	SSLKey             string `long:"sslkey"               description:"client certificate key file"`
+	SSLPassword        string `long:"sslpassword"          description:"password of an encrypted client certificate key"`
+}
+
+// Settings are connection settings keyed by libpq parameter name, such
+// as host, port, user, password and sslmode
+type Settings map[string]string
+
+// Settings returns the connection settings from the options, with the
+// individual options overriding those in the connection string
+func (o Options) Settings() (Settings, error) {
+	s, err := Parse(o.DSN)
+	if err != nil {
+		return nil, err
+	}
+	s.Set("host", o.Host)
+	s.Set("port", o.Port)
+	s.Set("user", o.User)
+	s.Set("password", o.Pass)
+	s.Set("service", o.Service)
+	s.Set("target_session_attrs", o.TargetSessionAttrs)
+	s.Set("sslmode", o.SSLMode)
+	s.Set("sslrootcert", o.SSLRootCert)
+	s.Set("sslcert", o.SSLCert)
+	s.Set("sslkey", o.SSLKey)
+	s.Set("sslpassword", o.SSLPassword)
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check checks the hosts, ports and sslmode of the settings. Hosts may
+// be host names, IPv4 or IPv6 addresses, optionally in brackets, or
+// Unix-domain socket directories, and may be comma separated, with
+// either one port or a port for each host. Brackets are removed from
+// IPv6 addresses.
+func (s Settings) Check() error {
+	if m, ok := s["sslmode"]; ok && !sslModes[m] {
+		return fmt.Errorf("invalid sslmode %q", m)
+	}
+	hosts := []string{}
+	if h, ok := s["host"]; ok {
+		hosts = strings.Split(h, ",")
+		for i, host := range hosts {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			if !validHost(host) {
+				return fmt.Errorf("invalid host %q", hosts[i])
+			}
+			hosts[i] = host
+		}
+		s["host"] = strings.Join(hosts, ",")
+	}
+	if p, ok := s["port"]; ok {
+		ports := strings.Split(p, ",")
+		for _, port := range ports {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid port %q", port)
+			}
+		}
+		// hosts taken from PGHOST are checked by the driver
+		if len(ports) > 1 && len(hosts) > 0 && len(ports) != len(hosts) {
+			return fmt.Errorf("%d ports given for %d hosts", len(ports), len(hosts))
+		}
+	}
+	return nil
+}
+
+// validHost reports if host is an IP address, a Unix-domain socket
+// directory or a host name
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil || strings.HasPrefix(host, "/") {
+		return true
+	}
+	return hostnameRegexp.MatchString(host)
+}
+
+// Set sets a setting if value is not empty
+func (s Settings) Set(key, value string) {
+	if value != "" {
+		s[key] = value
+	}
+}
+
+// Copy returns a copy of the settings
+func (s Settings) Copy() Settings {
+	c := Settings{}
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
+
+// ConnString returns a keyword/value connection string for the
+// database, or for the database in the settings if database is empty.
+// Keys are sorted and values quoted and escaped. A client certificate
+// with an encrypted key, which the driver does not support, is omitted
+// for setting from Certificate instead.
+func (s Settings) ConnString(database string) string {
+	c := s.Copy()
+	c.Set("dbname", database)
+	if _, ok := c["sslpassword"]; ok {
+		delete(c, "sslcert")
+		delete(c, "sslkey")
+		delete(c, "sslpassword")
+	}
+	return c.join()
+}
+
+// join returns the settings as a keyword/value connection string
+func (s Settings) join() string {
+	keys := []string{}
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, k+"="+quote(s[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// String returns a keyword/value connection string for the settings
+// with any passwords masked, for logging
+func (s Settings) String() string {
+	c := s.Copy()
+	for _, k := range []string{"password", "sslpassword"} {
+		if _, ok := c[k]; ok {
+			c[k] = "********"
+		}
+	}
+	return c.join()
+}
+
+// quote quotes and escapes a keyword/value connection string value
+func quote(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// Parse parses a connection string in keyword/value or url form into
+// settings
+func Parse(dsn string) (Settings, error) {
+	dsn = strings.TrimSpace(dsn)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return parseURL(dsn)
+	}
+	return parseKeywords(dsn)
+}
+
+// parseURL parses a url connection string, which may have several
+// comma separated host:port pairs. The hosts are split out before
+// parsing the remainder of the url, as net/url does not support
+// multiple hosts.
+func parseURL(dsn string) (Settings, error) {
+	scheme := strings.Index(dsn, "://") + 3
+	end := strings.IndexAny(dsn[scheme:], "/?")
+	if end < 0 {
+		end = len(dsn)
+	} else {
+		end += scheme
+	}
+	authority := dsn[scheme:end]
+	hostList := authority
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		hostList = authority[at+1:]
+		authority = authority[:at+1]
+	} else {
+		authority = ""
+	}
+
+	u, err := url.Parse(dsn[:scheme] + authority + dsn[end:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection url: %w", err)
+	}
+	s := Settings{}
+	if u.User != nil {
+		s.Set("user", u.User.Username())
+		if p, ok := u.User.Password(); ok {
+			s.Set("password", p)
+		}
+	}
+	hosts, ports := []string{}, []string{}
+	for _, hp := range strings.Split(hostList, ",") {
+		if hp == "" {
+			continue
+		}
+		host, port := hp, ""
+		if i := strings.LastIndex(hp, ":"); i >= 0 && !strings.HasSuffix(hp, "]") {
+			host, port = hp[:i], hp[i+1:]
+		}
+		if _, err := strconv.Atoi(port); port != "" && err != nil {
+			return nil, fmt.Errorf("invalid connection url: invalid port %q", port)
+		}
+		// socket directories are percent-encoded, as in %2Ftmp
+		host, err := url.PathUnescape(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection url: invalid host %q", hp)
+		}
+		hosts = append(hosts, strings.Trim(host, "[]"))
+		ports = append(ports, port)
+	}
+	s.Set("host", strings.Join(hosts, ","))
+	if strings.Join(ports, "") != "" {
+		// the driver requires a port for each host if any are given
+		for i, p := range ports {
+			if p == "" {
+				ports[i] = defaultPort
+			}
+		}
+		s.Set("port", strings.Join(ports, ","))
+	}
+	s.Set("dbname", strings.TrimPrefix(u.Path, "/"))
+	for k, v := range u.Query() {
+		s.Set(k, v[0])
+	}
+	return s, nil
+}
+
+// parseKeywords parses a keyword/value connection string, in which
+// values may be single quoted with backslash escapes
+func parseKeywords(dsn string) (Settings, error) {
+	s := Settings{}
+	for dsn = strings.TrimSpace(dsn); dsn != ""; dsn = strings.TrimSpace(dsn) {
+		eq := strings.Index(dsn, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("invalid connection string: missing = after %q", dsn)
+		}
+		key := strings.TrimSpace(dsn[:eq])
+		dsn = strings.TrimLeft(dsn[eq+1:], " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(dsn, "'") {
+			i, closed := 1, false
+			for ; i < len(dsn); i++ {
+				if dsn[i] == '\\' && i+1 < len(dsn) {
+					i++
+					value.WriteByte(dsn[i])
+					continue
+				}
+				if dsn[i] == '\'' {
+					closed = true
+					break
+				}
+				value.WriteByte(dsn[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("invalid connection string: unterminated quote for %s", key)
+			}
+			dsn = dsn[i+1:]
+		} else {
+			end := strings.IndexAny(dsn, " \t")
+			if end < 0 {
+				end = len(dsn)
+			}
+			value.WriteString(strings.ReplaceAll(dsn[:end], `\`, ""))
+			dsn = dsn[end:]
+		}
+		s[key] = value.String()
+	}
+	return s, nil
+}
@@ -0,0 +1,235 @@
+package pgconnect
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net"
+)
+
+// tlsVersions are the names of tls versions
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// TLSVersion returns the negotiated tls version of a connection, or an
+// empty string if the connection does not use tls
+func TLSVersion(c net.Conn) string {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	v := tc.ConnectionState().Version
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("TLS 0x%04x", v)
+}
+
+// Certificate returns the client certificate for settings with an
+// sslpassword, decrypting its key, or nil otherwise. Keys encrypted in
+// the traditional PEM format, or as PKCS#8 "ENCRYPTED PRIVATE KEY"s
+// using PBES2 with PBKDF2 and AES-CBC, as openssl does by default, are
+// supported.
+func (s Settings) Certificate() (*tls.Certificate, error) {
+	password, ok := s["sslpassword"]
+	if !ok {
+		return nil, nil
+	}
+	if s["sslcert"] == "" || s["sslkey"] == "" {
+		return nil, errors.New("sslpassword requires sslcert and sslkey")
+	}
+	certPEM, err := ioutil.ReadFile(s["sslcert"])
+	if err != nil {
+		return nil, fmt.Errorf("could not read sslcert: %w", err)
+	}
+	keyPEM, err := ioutil.ReadFile(s["sslkey"])
+	if err != nil {
+		return nil, fmt.Errorf("could not read sslkey: %w", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no pem key found in %s", s["sslkey"])
+	}
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		der, err := decryptPKCS8(block.Bytes, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt sslkey: %w", err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	case x509.IsEncryptedPEMBlock(block):
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt sslkey: %w", err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// SetCertificate sets the client certificate of each non-nil tls
+// configuration, such as those of a driver's host fallbacks
+func SetCertificate(cert *tls.Certificate, configs ...*tls.Config) {
+	if cert == nil {
+		return
+	}
+	for _, c := range configs {
+		if c != nil {
+			c.Certificates = []tls.Certificate{*cert}
+		}
+	}
+}
+
+// object identifiers of the PKCS#8 key encryption schemes supported
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is a PKCS#8 encrypted private key
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+// pbes2Params are the parameters of the PBES2 encryption scheme
+type pbes2Params struct {
+	KeyDerivation pkix.AlgorithmIdentifier
+	Encryption    pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of the PBKDF2 key derivation
+// function, with a prf defaulting to hmacWithSHA1
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts a PKCS#8 encrypted private key with password,
+// returning the der encoded PKCS#8 private key
+func decryptPKCS8(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption scheme %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivation.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s, only PBKDF2 is supported", params.KeyDerivation.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivation.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %w", err)
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 prf %s", kdf.PRF.Algorithm)
+	}
+	var keyLength int
+	switch {
+	case params.Encryption.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.Encryption.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.Encryption.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("unsupported key cipher %s, only AES-CBC is supported", params.Encryption.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Encryption.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC iv")
+	}
+	if kdf.Iterations < 1 || (kdf.KeyLength != 0 && kdf.KeyLength != keyLength) {
+		return nil, errors.New("invalid PBKDF2 parameters")
+	}
+	if len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted key length")
+	}
+
+	block, err := aes.NewCipher(pbkdf2(prf, password, kdf.Salt, kdf.Iterations, keyLength))
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(key, info.Data)
+
+	// a wrong password is found by invalid padding or key encoding
+	n := int(key[len(key)-1])
+	if n == 0 || n > aes.BlockSize {
+		return nil, x509.IncorrectPasswordError
+	}
+	for _, b := range key[len(key)-n:] {
+		if int(b) != n {
+			return nil, x509.IncorrectPasswordError
+		}
+	}
+	key = key[:len(key)-n]
+	if _, err := x509.ParsePKCS8PrivateKey(key); err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+	return key, nil
+}
+
+// pbkdf2 derives a key of keyLength bytes from password and salt, as
+// described in RFC 8018
+func pbkdf2(prf func() hash.Hash, password, salt []byte, iterations, keyLength int) []byte {
+	mac := hmac.New(prf, password)
+	var key []byte
+	var index [4]byte
+	for i := uint32(1); len(key) < keyLength; i++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.BigEndian.PutUint32(index[:], i)
+		mac.Write(index[:])
+		u := mac.Sum(nil)
+		t := append([]byte{}, u...)
+		for j := 1; j < iterations; j++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
@@ -5,4 +5,7 @@ go 1.15
 require (
 	github.com/jackc/pgx/v4 v4.10.1
 	github.com/jessevdk/go-flags v1.4.0
+	github.com/rorycl/pgtools/pgconnect v0.0.0
 )
+
+replace github.com/rorycl/pgtools/pgconnect => ../go-pgconnect
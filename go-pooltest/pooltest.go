@@ -7,26 +7,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/pgtools/pgconnect"
 )
 
-func dbquery(id int, url string, sleep int, wg *sync.WaitGroup) {
+func dbquery(id int, config *pgx.ConnConfig, sleep int, tlsConns *tlsCounter, wg *sync.WaitGroup) {
 
 	defer wg.Done()
 
-	conn, err := pgx.Connect(context.Background(), url)
+	conn, err := pgx.ConnectConfig(context.Background(), config)
 	if err != nil {
 		fmt.Printf("Unable to connect to database: %v\n", err)
 		return
 	}
 	defer conn.Close(context.Background())
+	tlsConns.add(pgconnect.TLSVersion(conn.PgConn().Conn()))
 
 	t1 := time.Now()
 	_, err = conn.Exec(context.Background(), "select pg_sleep($1)", sleep)
@@ -39,22 +43,79 @@ func dbquery(id int, url string, sleep int, wg *sync.WaitGroup) {
 	fmt.Printf("runtime for %3d: %v\n", id, t2.Sub(t1))
 }
 
+// tlsCounter counts connections by negotiated tls version
+type tlsCounter struct {
+	mu       sync.Mutex
+	versions map[string]int
+}
+
+// add counts a connection with the tls version, or without tls if
+// version is empty
+func (t *tlsCounter) add(version string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if version == "" {
+		version = "none"
+	}
+	t.versions[version]++
+}
+
+// String reports the connection counts by tls version
+func (t *tlsCounter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	versions := []string{}
+	for v := range t.versions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	for i, v := range versions {
+		versions[i] = fmt.Sprintf("%s %d", v, t.versions[v])
+	}
+	return strings.Join(versions, ", ")
+}
+
+// connConfig returns the connection configuration for a database,
+// setting the client certificate, if any
+func connConfig(settings pgconnect.Settings, cert *tls.Certificate, database string) (*pgx.ConnConfig, error) {
+	config, err := pgx.ParseConfig(settings.ConnString(database))
+	if err != nil {
+		return nil, err
+	}
+	configs := []*tls.Config{config.TLSConfig}
+	for _, f := range config.Fallbacks {
+		configs = append(configs, f.TLSConfig)
+	}
+	pgconnect.SetCertificate(cert, configs...)
+	return config, nil
+}
+
 // Options show flag options
 type Options struct {
-	User      string   `short:"u" long:"user"      description:"database user" required:"true"`
-	Pass      string   `short:"p" long:"password"  description:"database pass" required:"true"`
+	pgconnect.Options `group:"Connection Options"`
+
 	Databases []string `short:"d" long:"databases" description:"database/s for pool tests" required:"true"`
-	Port      int      `short:"P" long:"port"      description:"server port" default:"6432"`
-	Host      string   `short:"H" long:"host"      description:"server host" default:"127.0.0.1"`
 	Wait      int      `short:"w" long:"wait"      description:"per-connection pg_sleep seconds" default:"10"`
 	Sleep     int      `short:"s" long:"sleep"     description:"milliseconds between launching next query" default:"800"`
 	Conns     int      `short:"c" long:"conns"     description:"number of database connections per database" default:"10"`
 }
 
-// dburl constructs a database connection url
-func (o *Options) dburl(database string) string {
-	var tpl = "postgres://%s:%s@%s:%v/%s"
-	return fmt.Sprintf(tpl, o.User, o.Pass, o.Host, o.Port, database)
+// defaultPort is the pgbouncer port used if no port is set by the
+// options, connection string, PGPORT or a service
+const defaultPort = "6432"
+
+// settings returns the connection settings from the options
+func (o *Options) settings() (pgconnect.Settings, error) {
+	s, err := o.Settings()
+	if err != nil {
+		return nil, err
+	}
+	_, port := s["port"]
+	_, service := s["service"]
+	if !port && !service && os.Getenv("PGPORT") == "" && os.Getenv("PGSERVICE") == "" {
+		s["port"] = defaultPort
+	}
+	return s, nil
 }
 
 var usage = `
@@ -74,8 +135,9 @@ func main() {
 		os.Exit(1)
 	}
 
-	if options.User == "" || options.Pass == "" {
-		fmt.Println("Both database user and password must be supplied")
+	settings, err := options.settings()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
@@ -91,10 +153,12 @@ func main() {
 		}
 	}
 
-	if net.ParseIP(options.Host) == nil {
-		fmt.Println("Invalid IP address for host")
+	cert, err := settings.Certificate()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	tlsConns := &tlsCounter{versions: map[string]int{}}
 
 	var wg sync.WaitGroup
 	start := time.Now()
@@ -104,12 +168,17 @@ func main() {
 		for _, d := range options.Databases {
 			counter++
 			time.Sleep(sleepDuration)
-			db := options.dburl(d)
+			config, err := connConfig(settings, cert, d)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
 			fmt.Printf("%3d : %s\n", counter, d)
 			wg.Add(1)
-			go dbquery(counter, db, options.Wait, &wg)
+			go dbquery(counter, config, options.Wait, tlsConns, &wg)
 		}
 	}
 	wg.Wait()
 	fmt.Printf("\nTotal runtime %v\n", time.Now().Sub(start))
+	fmt.Printf("Connections by tls version: %s\n", tlsConns)
 }